@@ -7,7 +7,6 @@ import (
 	"net"
 	"strconv"
 	"strings"
-	"time"
 )
 
 type NTPv1Header struct {
@@ -46,20 +45,12 @@ func parseNTPv1Response(data []byte, t1_uint uint64, t4_uint uint64) (map[string
 		return nil, fmt.Errorf("response too short: %d bytes", len(data))
 	}
 
-	t1 := ntp64ToFloatSeconds(t1_uint)
-	t4 := ntp64ToFloatSeconds(t4_uint)
 	h := NTPv1Header{}
 	buf := bytes.NewReader(data[:48])
 	if err := binary.Read(buf, binary.BigEndian, &h); err != nil {
 		return nil, err
 	}
 
-	t2 := ntp64ToFloatSeconds(h.RecvTimestamp)
-	t3 := ntp64ToFloatSeconds(h.TxTimestamp)
-
-	rtt := (t4 - t1) - (t3 - t2)
-	offset := ((t2 - t1) + (t3 - t4)) / 2
-
 	info := map[string]interface{}{
 		"li_status":      h.LIStatus,
 		"type":           h.Type,
@@ -71,9 +62,8 @@ func parseNTPv1Response(data []byte, t1_uint uint64, t4_uint uint64) (map[string
 		"orig_timestamp": h.OrigTimestamp,
 		"recv_timestamp": h.RecvTimestamp,
 		"tx_timestamp":   h.TxTimestamp,
-		"rtt":            rtt,
-		"offset":         offset,
 	}
+	addOffsetAndRtt(info, t1_uint, h.RecvTimestamp, h.TxTimestamp, t4_uint)
 	if info["orig_timestamp"] == uint64(0) {
 		info["anomaly"] = "timestamps are invalid, orig_timestamp (t1) is 0"
 	} else if info["recv_timestamp"] == uint64(0) {
@@ -84,13 +74,13 @@ func parseNTPv1Response(data []byte, t1_uint uint64, t4_uint uint64) (map[string
 	return info, nil
 }
 
-func performNTPv1Measurement(server string, timeout float64) (map[string]interface{}, string, int) {
+func performNTPv1Measurement(server string, timeout float64, opts MeasurementOptions) (map[string]interface{}, string, int) {
 
 	var output strings.Builder
 	error_message := map[string]interface{}{}
 	addr := net.JoinHostPort(server, strconv.Itoa(123))
 
-	conn, err := net.Dial("udp", addr)
+	conn, err := dialNTP(addr, timeout, opts)
 	if err != nil {
 		m := fmt.Sprintf("error connecting: %v\n", err)
 		output.WriteString(m)
@@ -104,49 +94,33 @@ func performNTPv1Measurement(server string, timeout float64) (map[string]interfa
 		}
 	}(conn)
 
-	req, t1 := buildNTPv1Request()
-	_, err = conn.Write(req)
-	if err != nil {
-		m := fmt.Sprintf("could not send data: %v\n", err)
-		output.WriteString(m)
-		error_message["error"] = m
-		return error_message, output.String(), 2
-	}
-
-	err = conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
-	if err != nil {
-		m := fmt.Sprintf("error reading bytes: %v\n", err)
-		output.WriteString(m)
-		error_message["error"] = m
-		return error_message, output.String(), 3
-	}
-	resp := make([]byte, 1024)
-	n, err := conn.Read(resp)
+	req, _ := buildNTPv1Request()
+	ex, code, err := sendAndReceive(conn, req, timeout, opts)
 	if err != nil {
-		m := fmt.Sprintf("measurement timeout: %v\n", err)
+		m := fmt.Sprintf("%v\n", err)
 		output.WriteString(m)
 		error_message["error"] = m
-		return error_message, output.String(), 3
+		return error_message, output.String(), code
 	}
 
-	t4_uint := nowToNtpUint64()
-
 	// Get the server IP we actually measured
 	remoteAddr := conn.RemoteAddr().(*net.UDPAddr)
 	measuredIP := remoteAddr.IP.String()
 
-	result, err := parseAccordingToRightVersion(resp[:n], t1, t4_uint, 0, "", &output) //parseNTPv1Response(resp[:n], t1, t4_uint)
+	result, err := parseAccordingToRightVersion(ex.Packet, ex.T1, ex.T4, 0, "", &output) //parseNTPv1Response(resp[:n], t1, t4_uint)
 
 	if err != nil {
 		m := fmt.Sprintf("error parsing response: %v\n", err)
 		output.WriteString(m)
 		error_message["error"] = m
+		addRawPackets(error_message, ex.Request, ex.Response) // the server answered, keep what it sent
 		return error_message, output.String(), 4
 	}
 
 	if result != nil {
 		result["Host"] = server
 		result["Measured server IP"] = measuredIP
+		addExchangeInfo(result, ex)
 	}
 	return result, output.String(), 0
 }
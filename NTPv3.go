@@ -7,7 +7,6 @@ import (
 	"net"
 	"strconv"
 	"strings"
-	"time"
 )
 
 type NTPv3Header struct { //same as NTPv4
@@ -50,14 +49,6 @@ func parseNTPv3Response(data []byte, t1_uint uint64, t4_uint uint64) (map[string
 		return nil, err
 	}
 
-	t1 := ntp64ToFloatSeconds(t1_uint)
-	t2 := ntp64ToFloatSeconds(h.RecvTimestamp)
-	t3 := ntp64ToFloatSeconds(h.TxTimestamp)
-	t4 := ntp64ToFloatSeconds(t4_uint)
-
-	rtt := (t4 - t1) - (t3 - t2)
-	offset := ((t2 - t1) + (t3 - t4)) / 2
-
 	info := map[string]interface{}{
 		"leap":             (h.LIVNMode >> 6) & 0x03,
 		"version":          (h.LIVNMode >> 3) & 0x07,
@@ -73,9 +64,8 @@ func parseNTPv3Response(data []byte, t1_uint uint64, t4_uint uint64) (map[string
 		"recv_timestamp":   h.RecvTimestamp,
 		"tx_timestamp":     h.TxTimestamp,
 		"client_recv_time": t4_uint, //we add this field to be shown in the results
-		"rtt":              rtt,
-		"offset":           offset,
 	}
+	addOffsetAndRtt(info, t1_uint, h.RecvTimestamp, h.TxTimestamp, t4_uint)
 	if info["orig_timestamp"] == uint64(0) {
 		info["anomaly"] = "timestamps are invalid, orig_timestamp (t1) is 0"
 	} else if info["recv_timestamp"] == uint64(0) {
@@ -86,13 +76,13 @@ func parseNTPv3Response(data []byte, t1_uint uint64, t4_uint uint64) (map[string
 	return info, nil
 }
 
-func performNTPv3Measurement(server string, timeout float64, ntpVersion int) (map[string]interface{}, string, int) {
+func performNTPv3Measurement(server string, timeout float64, ntpVersion int, opts MeasurementOptions) (map[string]interface{}, string, int) {
 
 	var output strings.Builder
 	error_message := map[string]interface{}{}
 	addr := net.JoinHostPort(server, strconv.Itoa(123))
 
-	conn, err := net.Dial("udp", addr)
+	conn, err := dialNTP(addr, timeout, opts)
 	if err != nil {
 		m := fmt.Sprintf("error connecting: %v\n", err)
 		output.WriteString(m)
@@ -106,49 +96,33 @@ func performNTPv3Measurement(server string, timeout float64, ntpVersion int) (ma
 		}
 	}(conn)
 
-	req, t1 := buildNTPv3or2Request(ntpVersion)
-	_, err = conn.Write(req)
-	if err != nil {
-		m := fmt.Sprintf("could not send data: %v\n", err)
-		output.WriteString(m)
-		error_message["error"] = m
-		return error_message, output.String(), 2
-	}
-
-	err = conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
-	if err != nil {
-		m := fmt.Sprintf("error reading bytes: %v\n", err)
-		output.WriteString(m)
-		error_message["error"] = m
-		return error_message, output.String(), 3
-	}
-	resp := make([]byte, 1024)
-	n, err := conn.Read(resp)
+	req, _ := buildNTPv3or2Request(ntpVersion)
+	ex, code, err := sendAndReceive(conn, req, timeout, opts)
 	if err != nil {
-		m := fmt.Sprintf("measurement timeout: %v\n", err)
+		m := fmt.Sprintf("%v\n", err)
 		output.WriteString(m)
 		error_message["error"] = m
-		return error_message, output.String(), 3
+		return error_message, output.String(), code
 	}
 
-	t4_uint := nowToNtpUint64()
-
 	// Get the server IP we actually measured
 	remoteAddr := conn.RemoteAddr().(*net.UDPAddr)
 	measuredIP := remoteAddr.IP.String()
 	//IMPORTANT. Check if the returned version is NTPv5, otherwise, parse according to the right NTP version
-	result, err := parseAccordingToRightVersion(resp[:n], t1, t4_uint, 0, "", &output) //parseNTPv3Response(resp[:n], t1, t4)
+	result, err := parseAccordingToRightVersion(ex.Packet, ex.T1, ex.T4, 0, "", &output) //parseNTPv3Response(resp[:n], t1, t4)
 
 	if err != nil {
 		m := fmt.Sprintf("error parsing response: %v\n", err)
 		output.WriteString(m)
 		error_message["error"] = m
+		addRawPackets(error_message, ex.Request, ex.Response) // the server answered, keep what it sent
 		return error_message, output.String(), 4
 	}
 
 	if result != nil {
 		result["Host"] = server
 		result["Measured server IP"] = measuredIP
+		addExchangeInfo(result, ex)
 	}
 	return result, output.String(), 0
 }
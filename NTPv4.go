@@ -7,7 +7,6 @@ import (
 	"net"
 	"strconv"
 	"strings"
-	"time"
 )
 
 // NTPv4 constants
@@ -32,11 +31,19 @@ type NTPv4Header struct {
 }
 
 func buildNTPv4Request() ([]byte, uint64) {
+	return buildNTPv4RequestWithTimestamps(0, 0)
+}
+
+// buildNTPv4RequestWithTimestamps also fills the origin and receive timestamps of the request (used by interleaved mode)
+func buildNTPv4RequestWithTimestamps(origin uint64, receive uint64) ([]byte, uint64) {
 	req := make([]byte, NTP_PACKET_SIZE)
 
 	// LI = 0 (no warning), VN = 4, Mode = 3 (client)
 	req[0] = (0 << 6) | (NTPV4_VERSION << 3) | MODE_CLIENT
 
+	binary.BigEndian.PutUint64(req[24:], origin)
+	binary.BigEndian.PutUint64(req[32:], receive)
+
 	t1 := nowToNtpUint64() //timeToNtp64(time.Now())
 	binary.BigEndian.PutUint64(req[40:], t1)
 
@@ -55,14 +62,6 @@ func parseNTPv4Response(data []byte, t1_uint uint64, t4_uint uint64, debug_outpu
 		return nil, err
 	}
 
-	t1 := ntp64ToFloatSeconds(t1_uint)
-	t2 := ntp64ToFloatSeconds(h.RecvTimestamp)
-	t3 := ntp64ToFloatSeconds(h.TxTimestamp)
-	t4 := ntp64ToFloatSeconds(t4_uint)
-
-	rtt := (t4 - t1) - (t3 - t2)
-	offset := ((t2 - t1) + (t3 - t4)) / 2
-
 	info := map[string]interface{}{ //same as NTPv3
 		"leap":             (h.LIVNMode >> 6) & 0x03,
 		"version":          (h.LIVNMode >> 3) & 0x07,
@@ -78,9 +77,8 @@ func parseNTPv4Response(data []byte, t1_uint uint64, t4_uint uint64, debug_outpu
 		"recv_timestamp":   h.RecvTimestamp, //t2
 		"tx_timestamp":     h.TxTimestamp,   //t3
 		"client_recv_time": t4_uint,         //we add this field to be shown in the results
-		"rtt":              rtt,
-		"offset":           offset,
 	}
+	addOffsetAndRtt(info, t1_uint, h.RecvTimestamp, h.TxTimestamp, t4_uint)
 	if info["orig_timestamp"] == uint64(0) {
 		info["anomaly"] = "timestamps are invalid, orig_timestamp (t1) is 0"
 	} else if info["recv_timestamp"] == uint64(0) {
@@ -114,14 +112,14 @@ func parseNTPv4Response(data []byte, t1_uint uint64, t4_uint uint64, debug_outpu
 	return info, nil
 }
 
-func performNTPv4Measurement(server string, timeout float64) (map[string]interface{}, string, int) {
+func performNTPv4Measurement(server string, timeout float64, opts MeasurementOptions) (map[string]interface{}, string, int) {
 
 	var output strings.Builder
 	error_message := map[string]interface{}{}
 	//addr := fmt.Sprintf("%s:%d", server, 123)
 	addr := net.JoinHostPort(server, strconv.Itoa(123))
 
-	conn, err := net.Dial("udp", addr)
+	conn, err := dialNTP(addr, timeout, opts)
 	if err != nil {
 		//fmt.Printf("error connecting: %v\n", err)
 		m := fmt.Sprintf("error connecting: %v\n", err)
@@ -137,52 +135,34 @@ func performNTPv4Measurement(server string, timeout float64) (map[string]interfa
 		}
 	}(conn)
 
-	req, t1 := buildNTPv4Request()
+	req, _ := buildNTPv4Request()
 	output.WriteString(fmt.Sprintf("Packet ntpv4 size sent: %d bytes\n", len(req)))
-	_, err = conn.Write(req)
+	ex, code, err := sendAndReceive(conn, req, timeout, opts)
 	if err != nil {
-		m := fmt.Sprintf("could not send request: %v\n", err)
+		m := fmt.Sprintf("%v\n", err)
 		output.WriteString(m)
-		//os.Exit(2)
 		error_message["error"] = m
-		return error_message, output.String(), 2
+		return error_message, output.String(), code
 	}
 
-	err = conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
-	if err != nil {
-		m := fmt.Sprintf("error reading bytes: %v\n", err)
-		output.WriteString(m)
-		error_message["error"] = m
-		return error_message, output.String(), 3
-	}
-	resp := make([]byte, 1024)
-	n, err := conn.Read(resp)
-	if err != nil {
-		m := fmt.Sprintf("measurement timeout: %v\n", err)
-		output.WriteString(m)
-		//os.Exit(3)
-		error_message["error"] = m
-		return error_message, output.String(), 3
-	}
-
-	t4_uint := nowToNtpUint64()
-
 	// Get the server IP we actually measured
 	remoteAddr := conn.RemoteAddr().(*net.UDPAddr)
 	measuredIP := remoteAddr.IP.String()
 	//IMPORTANT. Check if the returned version is NTPv5, otherwise, parse according to the right NTP version
-	result, err := parseAccordingToRightVersion(resp[:n], t1, t4_uint, 0, "", &output) //parseNTPv4Response(resp[:n], t1, t4, &output)
+	result, err := parseAccordingToRightVersion(ex.Packet, ex.T1, ex.T4, 0, "", &output) //parseNTPv4Response(resp[:n], t1, t4, &output)
 
 	if err != nil {
 		m := fmt.Sprintf("error reading/parsing response: %v\n", err)
 		output.WriteString(m)
 		error_message["error"] = m
+		addRawPackets(error_message, ex.Request, ex.Response) // the server answered, keep what it sent
 		return error_message, output.String(), 4
 	}
 
 	if result != nil {
 		result["Host"] = server
 		result["Measured server IP"] = measuredIP
+		addExchangeInfo(result, ex)
 	}
 	return result, output.String(), 0
 }
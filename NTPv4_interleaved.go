@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NTPv4 interleaved mode (as implemented by chrony with "xleave"). After a first basic exchange, every request carries
+// in its origin timestamp the server's receive timestamp of the previous response, and in its receive timestamp the
+// time when we received the previous response. A server supporting interleaved mode recognizes its own receive
+// timestamp and answers with:
+//   - origin timestamp = the receive timestamp of our request (instead of our transmit timestamp)
+//   - transmit timestamp = the (hardware/driver) transmit timestamp of the previous response
+//
+// So we know if the response is interleaved by looking at the origin timestamp, and an interleaved response completes
+// the previous exchange with a more accurate t3.
+
+// performNTPv4InterleavedMeasurement performs "samples" consecutive NTPv4 exchanges on the same socket, asking for
+// interleaved mode from the second one. The result is the first (basic) response, with all the exchanges and the
+// basic vs interleaved offsets in "interleaved".
+func performNTPv4InterleavedMeasurement(server string, timeout float64, samples int, opts MeasurementOptions) (map[string]interface{}, string, int) {
+
+	var output strings.Builder
+	error_message := map[string]interface{}{}
+	addr := net.JoinHostPort(server, strconv.Itoa(123))
+
+	conn, err := dialNTP(addr, timeout, opts)
+	if err != nil {
+		m := fmt.Sprintf("error connecting: %v\n", err)
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 1
+	}
+	defer func(conn net.Conn) {
+		err := conn.Close()
+		if err != nil {
+			return
+		}
+	}(conn)
+	measuredIP := conn.RemoteAddr().(*net.UDPAddr).IP.String()
+
+	var first map[string]interface{}
+	exchanges := []map[string]interface{}{}
+	var prev map[string]interface{} // previous exchange
+	var prevT1, prevT2, prevT4 uint64
+	interleavedCount := 0
+	requestBytes, responseBytes, responseDatagrams := 0, 0, 0 // all the requests of the series
+	for i := 0; i < samples; i++ {
+		if i > 0 {
+			time.Sleep(300 * time.Millisecond) // do not spam the server
+		}
+		// the first request is a basic one (origin and receive are 0)
+		req, _ := buildNTPv4RequestWithTimestamps(prevT2, prevT4)
+		output.WriteString(fmt.Sprintf("exchange %d: interleaved requested: %v, origin: %v, receive: %v\n", i, prev != nil, prevT2, prevT4))
+		ex, code, err := sendAndReceive(conn, req, timeout, opts)
+		requestBytes += len(ex.Request)
+		responseBytes += ex.ReceivedBytes
+		responseDatagrams += ex.ReceivedDatagrams
+		if err != nil {
+			m := fmt.Sprintf("exchange %d: %v\n", i, err)
+			output.WriteString(m)
+			if first == nil {
+				error_message["error"] = m
+				return error_message, output.String(), code
+			}
+			break // keep what we have
+		}
+		t1, t4_uint := ex.T1, ex.T4
+		result, err := parseAccordingToRightVersion(ex.Packet, t1, t4_uint, 0, "", &output)
+		if err != nil {
+			m := fmt.Sprintf("error parsing response: %v\n", err)
+			output.WriteString(m)
+			error_message["error"] = m
+			return error_message, output.String(), 4
+		}
+		if result["version"] != uint8(NTPV4_VERSION) {
+			m := fmt.Sprintf("server answered with NTP version %v, interleaved mode needs NTPv4\n", result["version"])
+			output.WriteString(m)
+			error_message["error"] = m
+			return error_message, output.String(), 4
+		}
+		txTimestamp := binary.BigEndian.Uint64(ex.Request[40:48]) // what we sent (random in privacy mode)
+		origin := result["orig_timestamp"].(uint64)
+		isInterleaved := prev != nil && origin == prevT4
+		if origin != txTimestamp && !isInterleaved {
+			m := fmt.Sprintf("exchange %d: origin timestamp %v matches neither our transmit nor our receive timestamp\n", i, origin)
+			output.WriteString(m)
+			error_message["error"] = m
+			return error_message, output.String(), 4
+		}
+		if first == nil {
+			first = result
+			addExchangeInfo(first, ex)
+		}
+
+		t2 := result["recv_timestamp"].(uint64)
+		t3 := result["tx_timestamp"].(uint64)
+		exchange := map[string]interface{}{
+			"client_sent_time":     t1,
+			"server_recv_time":     t2,
+			"client_recv_time":     t4_uint,
+			"interleaved_response": isInterleaved,
+		}
+		addRawPackets(exchange, ex.Request, ex.Response)
+		addAmplification(exchange, len(ex.Request), ex.ReceivedBytes, ex.ReceivedDatagrams)
+		if isInterleaved {
+			// t3 is the transmit timestamp of the previous response
+			interleavedCount++
+			prev["server_sent_time_interleaved"] = t3
+			offsetNs, rttNs := offsetAndRttNanoseconds(prevT1, prevT2, t3, prevT4)
+			prev["interleaved_offset_ns"], prev["interleaved_rtt_ns"] = offsetNs, rttNs
+			prev["interleaved_offset"], prev["interleaved_rtt"] = float64(offsetNs)/1e9, float64(rttNs)/1e9
+		} else {
+			// basic response, t3 belongs to this exchange
+			exchange["server_sent_time"] = t3
+			exchange["basic_offset"] = result["offset"]
+			exchange["basic_rtt"] = result["rtt"]
+			exchange["basic_offset_ns"] = result["offset_ns"]
+			exchange["basic_rtt_ns"] = result["rtt_ns"]
+		}
+		exchanges = append(exchanges, exchange)
+		prev, prevT1, prevT2, prevT4 = exchange, t1, t2, t4_uint
+	}
+
+	interleaved := map[string]interface{}{
+		"samples":               len(exchanges),
+		"interleaved_responses": interleavedCount,
+		"supported":             interleavedCount > 0,
+		"exchanges":             exchanges,
+		"basic_offset":          exchanges[0]["basic_offset"],
+		"basic_rtt":             exchanges[0]["basic_rtt"],
+	}
+	if v, ok := exchanges[0]["interleaved_offset"]; ok {
+		// same exchange measured in both modes, the difference is the error of the basic transmit timestamp
+		interleaved["interleaved_offset"] = v
+		interleaved["interleaved_rtt"] = exchanges[0]["interleaved_rtt"]
+		diff := exchanges[0]["interleaved_offset_ns"].(int64) - exchanges[0]["basic_offset_ns"].(int64)
+		interleaved["offset_difference_ns"] = diff
+		interleaved["offset_difference"] = float64(diff) / 1e9
+	}
+	first["Host"] = server
+	first["Measured server IP"] = measuredIP
+	addAmplification(first, requestBytes, responseBytes, responseDatagrams)
+	first["interleaved"] = interleaved
+	return first, output.String(), 0
+}
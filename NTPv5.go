@@ -19,6 +19,60 @@ const (
 	HEADER_SIZE   = 48
 )
 
+// NTPv5 timescales (the client asks for one, the server tells which one it used)
+const (
+	TIMESCALE_TAI          = 1
+	TIMESCALE_UT1          = 2
+	TIMESCALE_LEAP_SMEARED = 3
+)
+
+var ntpv5TimescaleNames = map[uint8]string{
+	TIMESCALE_UTC:          "UTC",
+	TIMESCALE_TAI:          "TAI",
+	TIMESCALE_UT1:          "UT1",
+	TIMESCALE_LEAP_SMEARED: "leap-smeared UTC",
+}
+
+func ntpv5TimescaleName(timescale uint8) string {
+	if name, ok := ntpv5TimescaleNames[timescale]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown (%d)", timescale)
+}
+
+// parseNTPv5Timescale accepts "utc", "tai", "ut1", "smeared" (leap-smeared UTC) or the number of the timescale
+func parseNTPv5Timescale(s string) (uint8, error) {
+	switch strings.ToLower(s) {
+	case "", "utc":
+		return TIMESCALE_UTC, nil
+	case "tai":
+		return TIMESCALE_TAI, nil
+	case "ut1":
+		return TIMESCALE_UT1, nil
+	case "smeared", "leap-smeared", "leap-smeared-utc":
+		return TIMESCALE_LEAP_SMEARED, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("unknown timescale %q (use utc, tai, ut1, smeared or a number)", s)
+	}
+	return uint8(n), nil
+}
+
+// NTPv5 extension field types (temporary values used by the drafts)
+const (
+	NTPV5_EXT_PADDING         = 0xF501
+	NTPV5_EXT_MAC             = 0xF502
+	NTPV5_EXT_REFIDS_REQUEST  = 0xF503
+	NTPV5_EXT_REFIDS_RESPONSE = 0xF504
+	NTPV5_EXT_SERVER_INFO     = 0xF505
+	NTPV5_EXT_CORRECTION      = 0xF506
+	NTPV5_EXT_REF_TIMESTAMP   = 0xF507
+	NTPV5_EXT_MONOTONIC_RX    = 0xF508
+	NTPV5_EXT_SECONDARY_RX    = 0xF509
+	NTPV5_EXT_DRAFT_ID        = 0xF5FF
+)
+
 type NTPv5Header struct {
 	LIVNMode       uint8 // LI(2) | VN(3) | Mode(3)
 	Stratum        uint8
@@ -73,7 +127,21 @@ func decodeFlags(flags uint16) map[string]bool {
 		"auth_nak":     flags&0x4 != 0,
 	}
 }
+
+// NTPv5RequestOptions contains the fields of an NTPv5 request that callers may want to change.
+// The zero value produces the same request as buildNTPv5Request.
+type NTPv5RequestOptions struct {
+	Timescale    uint8
+	Flags        uint16
+	ServerCookie uint64
+	Extensions   [][]byte // already encoded extension fields (see buildExtensionField)
+}
+
 func buildNTPv5Request(draft string, debug_output *strings.Builder) ([]byte, uint64) {
+	return buildNTPv5RequestWithOptions(draft, NTPv5RequestOptions{}, debug_output)
+}
+
+func buildNTPv5RequestWithOptions(draft string, opts NTPv5RequestOptions, debug_output *strings.Builder) ([]byte, uint64) {
 	clientCookie := rand.Uint64()
 	buf := make([]byte, 48)
 
@@ -86,19 +154,24 @@ func buildNTPv5Request(draft string, debug_output *strings.Builder) ([]byte, uin
 	buf[2] = 0
 	// Byte 3: Precision = 0
 	buf[3] = 0
-	// Byte 4: Timescale (UTC=0)
-	buf[4] = 0
-	// Byte 5: Era
-	buf[5] = 0
-	// Bytes 6-7: Flags (uint16)
-	binary.BigEndian.PutUint16(buf[6:8], 0)
-	// Bytes 8-11: Root Delay (uint32)
-	binary.BigEndian.PutUint32(buf[8:12], 0)
-	// Bytes 12-15: Root Dispersion (uint32)
-	binary.BigEndian.PutUint32(buf[12:16], 0)
+	// draft 05: timescale, era, flags (bytes 4-7) then root delay and root dispersion (bytes 8-15).
+	// draft 06: root delay and root dispersion (bytes 4-11) then timescale, era, flags (bytes 12-15)
+	rootDelayPos, timescalePos := 8, 4
+	if draft == "draft-ietf-ntp-ntpv5-06" {
+		rootDelayPos, timescalePos = 4, 12
+	}
+	// Timescale (UTC=0)
+	buf[timescalePos] = opts.Timescale
+	// Era (of our clock)
+	buf[timescalePos+1] = uint8(ntpEraOf(localNow()))
+	// Flags (uint16)
+	binary.BigEndian.PutUint16(buf[timescalePos+2:timescalePos+4], opts.Flags)
+	// Root Delay and Root Dispersion (uint32)
+	binary.BigEndian.PutUint32(buf[rootDelayPos:rootDelayPos+4], 0)
+	binary.BigEndian.PutUint32(buf[rootDelayPos+4:rootDelayPos+8], 0)
 
 	// Bytes 16-23: Server Cookie (uint64)
-	binary.BigEndian.PutUint64(buf[16:24], 0)
+	binary.BigEndian.PutUint64(buf[16:24], opts.ServerCookie)
 	// Bytes 24-31: Client Cookie (uint64)
 	binary.BigEndian.PutUint64(buf[24:32], clientCookie)
 
@@ -108,18 +181,19 @@ func buildNTPv5Request(draft string, debug_output *strings.Builder) ([]byte, uin
 	binary.BigEndian.PutUint64(buf[40:48], 0)
 	if draft != "" {
 		payload := []byte(draft)
-		//fmt.Printf("len draft name %v\n", len(payload))
-		//extLen := 1 + len(payload) // type + length + body
-		//len of draft is 23
-		//total length for this ext field: 2+2+23+1=27 but we need 28 to be multiple of 4
-		ext := make([]byte, 28)
-		binary.BigEndian.PutUint16(ext[0:2], 0xF5FF) // type
-		binary.BigEndian.PutUint16(ext[2:4], 27)     //it should be 27
+		// the declared length is the unpadded one (4+23=27 for the draft names), but the field is padded to a
+		// multiple of 4 in the packet (28 bytes) so that the next extension field starts at the right offset
+		ext := make([]byte, (4+len(payload)+3)&^3)
+		binary.BigEndian.PutUint16(ext[0:2], NTPV5_EXT_DRAFT_ID) // type
+		binary.BigEndian.PutUint16(ext[2:4], uint16(4+len(payload)))
 		copy(ext[4:], payload)
 		debug_output.WriteString(fmt.Sprintf("len draft (sent) ext field: %v, content: %v\n", len(ext), ext))
 		buf = append(buf, ext...)
 		//sudo chronyd -Q -t 10 -d -d -d 'server ntp0.testdns.nl xleave version 5'
 	}
+	for _, ext := range opts.Extensions {
+		buf = append(buf, ext...)
+	}
 	return buf, clientCookie
 }
 
@@ -139,7 +213,8 @@ func parseNTPv5Response(data []byte, clientCookie uint64, clientSentTime uint64,
 	//header := NTPv5Header_draft_05{}
 	buf := bytes.NewReader(data[:HEADER_SIZE])
 	info := map[string]interface{}{}
-	t2, t3 := -1.0, -1.0
+	t2_uint, t3_uint := uint64(0), uint64(0)
+	era := 0 // era of the receive and transmit timestamps
 	//in draft 06 the order of fields changed
 	if draft == "draft-ietf-ntp-ntpv5-06" {
 		header := NTPv5Header_draft_06{}
@@ -167,8 +242,8 @@ func parseNTPv5Response(data []byte, clientCookie uint64, clientSentTime uint64,
 			"tx_timestamp":        header.TxTimestamp,
 			"client_cookie_valid": header.ClientCookie == clientCookie,
 		}
-		t2 = ntp64ToFloatSeconds(header.RecvTimestamp)
-		t3 = ntp64ToFloatSeconds(header.TxTimestamp)
+		era = int(header.Era)
+		t2_uint, t3_uint = header.RecvTimestamp, header.TxTimestamp
 	} else {
 		header := NTPv5Header_draft_05{}
 		// here it is important what header format we use
@@ -194,12 +269,15 @@ func parseNTPv5Response(data []byte, clientCookie uint64, clientSentTime uint64,
 			"tx_timestamp":        header.TxTimestamp,
 			"client_cookie_valid": header.ClientCookie == clientCookie,
 		}
-		t2 = ntp64ToFloatSeconds(header.RecvTimestamp)
-		t3 = ntp64ToFloatSeconds(header.TxTimestamp)
+		era = int(header.Era)
+		t2_uint, t3_uint = header.RecvTimestamp, header.TxTimestamp
 	}
 
-	t4 := ntp64ToFloatSeconds(t4_uint)
 	info["client_recv_time"] = t4_uint
+	info["timescale_name"] = ntpv5TimescaleName(info["timescale"].(uint8))
+	info["era_name"] = ntpEraName(era)
+	info["recv_time"] = ntp64ToTimeInEra(info["recv_timestamp"].(uint64), era).UTC().Format(time.RFC3339Nano)
+	info["tx_time"] = ntp64ToTimeInEra(info["tx_timestamp"].(uint64), era).UTC().Format(time.RFC3339Nano)
 
 	if draft != "" {
 		info["draft"] = draft
@@ -228,7 +306,6 @@ func parseNTPv5Response(data []byte, clientCookie uint64, clientSentTime uint64,
 		info["extensions"] = exts
 	}
 	//add offset and rtt
-	t1 := ntp64ToFloatSeconds(clientSentTime)
 	info["orig_timestamp"] = clientSentTime
 	if info["recv_timestamp"] == uint64(0) {
 		info["anomaly"] = "timestamps are invalid, recv_timestamp (t2) is 0"
@@ -238,8 +315,8 @@ func parseNTPv5Response(data []byte, clientCookie uint64, clientSentTime uint64,
 	//t2 := ntp64ToFloatSeconds(header.RecvTimestamp)
 	//t3 := ntp64ToFloatSeconds(header.TxTimestamp)
 
-	info["offset"] = ((t2 - t1) + (t3 - t4)) / 2 //in seconds
-	info["rtt"] = (t4 - t1) - (t3 - t2)          //in seconds
+	// the differences do not depend on the era, so they are computed directly on the timestamps
+	addOffsetAndRtt(info, clientSentTime, t2_uint, t3_uint, t4_uint)
 	return info, nil
 }
 
@@ -248,14 +325,16 @@ func parseNTPv5Response(data []byte, clientCookie uint64, clientSentTime uint64,
 // you can see in "map[string]interface{}" exactly the error, in the second value you see debug messages and the error, and
 // third value has the error code. This is done such that in case you do not want debug messages, you can get exactly the output
 // or the error message. (only them will be printed on screen)
-func performNTPv5Measurement(server string, timeout float64, draft string) (map[string]interface{}, string, int) {
+// The timescale is the one we ask the server to use (TIMESCALE_UTC, TIMESCALE_TAI...). If the server answers in another
+// timescale, "timescale_mismatch" is true.
+func performNTPv5Measurement(server string, timeout float64, draft string, timescale uint8, opts MeasurementOptions) (map[string]interface{}, string, int) {
 
 	var output strings.Builder
 	error_message := map[string]interface{}{}
 	//addr := fmt.Sprintf("%s:%d", server, NTP_PORT)
 	addr := net.JoinHostPort(server, strconv.Itoa(123))
 
-	conn, err := net.DialTimeout("udp", addr, time.Duration(timeout)*time.Second)
+	conn, err := dialNTP(addr, timeout, opts)
 	if err != nil {
 		m := fmt.Sprintf("error connecting: %v\n", err)
 		output.WriteString(m)
@@ -272,56 +351,40 @@ func performNTPv5Measurement(server string, timeout float64, draft string) (map[
 	}(conn)
 	output.WriteString(fmt.Sprintf("connected to %v\n", addr))
 
-	t1 := nowToNtpUint64()
-	req, client_cookie := buildNTPv5Request(draft, &output)
+	req, client_cookie := buildNTPv5RequestWithOptions(draft, NTPv5RequestOptions{Timescale: timescale}, &output)
 	output.WriteString(fmt.Sprintf("Packet ntpv5 size sent: %d bytes\n", len(req)))
-	_, err = conn.Write(req)
-	if err != nil {
-		m := fmt.Sprintf("error sending ntpv5 request: %v\n", err)
-		output.WriteString(m)
-		//fmt.Printf("error sending ntpv5 request: %v\n", err)
-		//os.Exit(2)
-		error_message["error"] = m
-		return error_message, output.String(), 2
-	}
-
-	err = conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+	ex, code, err := sendAndReceive(conn, req, timeout, opts)
 	if err != nil {
-		m := fmt.Sprintf("error reading bytes: %v\n", err)
+		m := fmt.Sprintf("%v\n", err)
 		output.WriteString(m)
 		error_message["error"] = m
-		return error_message, output.String(), 3
+		return error_message, output.String(), code
 	}
-	resp := make([]byte, 1024)
-	n, err := conn.Read(resp)
-	if err != nil {
-		m := fmt.Sprintf("measurement timeout: %v\n", err)
-		output.WriteString(m)
-		//fmt.Printf("measurement timeout: %v\n", err)
-		//os.Exit(3)
-		error_message["error"] = m
-		return error_message, output.String(), 3
-	}
-	t4_uint := nowToNtpUint64()
 
 	// Get the server IP we actually measured
 	remoteAddr := conn.RemoteAddr().(*net.UDPAddr)
 	measuredIP := remoteAddr.IP.String()
 	// parsing response
 	//IMPORTANT. Check if the returned version is NTPv5, otherwise, parse according to the right NTP version
-	result, err := parseAccordingToRightVersion(resp[:n], t1, t4_uint, client_cookie, draft, &output) //parseNTPv5Response(resp[:n], client_cookie, t1, draft, &output)
+	result, err := parseAccordingToRightVersion(ex.Packet, ex.T1, ex.T4, client_cookie, draft, &output) //parseNTPv5Response(resp[:n], client_cookie, t1, draft, &output)
 	if err != nil {
 		m := fmt.Sprintf("error parsing response: %v\n", err)
 		output.WriteString(m)
 		//fmt.Printf("error parsing response: %v\n", err)
 		//os.Exit(4)
 		error_message["error"] = m
+		addRawPackets(error_message, ex.Request, ex.Response) // the server answered, keep what it sent
 		return error_message, output.String(), 4
 	}
 
 	if result != nil {
 		result["Host"] = server
 		result["Measured server IP"] = measuredIP
+		addExchangeInfo(result, ex)
+		if ts, ok := result["timescale"].(uint8); ok {
+			result["requested_timescale"] = ntpv5TimescaleName(timescale)
+			result["timescale_mismatch"] = ts != timescale
+		}
 	}
 	return result, output.String(), 0
 }
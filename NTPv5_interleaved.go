@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const NTPV5_FLAG_INTERLEAVED = 0x2
+
+// In NTPv5 interleaved mode the client sets the interleaved flag and echoes the server cookie of the previous
+// response. If the server still knows that cookie, it answers with the interleaved flag set and puts in the transmit
+// timestamp the (more accurate) time when the previous response really left the server. So the transmit timestamp
+// of response k belongs to exchange k-1:
+//
+//	interleaved offset(k-1) = ((t2[k-1] - t1[k-1]) + (t3[k] - t4[k-1])) / 2
+//	interleaved rtt(k-1)    = (t4[k-1] - t1[k-1]) - (t3[k] - t2[k-1])
+//
+// A response that is not interleaved can be used as a normal (basic) measurement.
+
+// performNTPv5InterleavedMeasurement performs "samples" consecutive NTPv5 exchanges on the same socket, asking for
+// interleaved mode from the second one. The result is the first (basic) response, with all the exchanges and the
+// basic vs interleaved offsets in "interleaved".
+func performNTPv5InterleavedMeasurement(server string, timeout float64, draft string, samples int, opts MeasurementOptions) (map[string]interface{}, string, int) {
+
+	var output strings.Builder
+	error_message := map[string]interface{}{}
+	addr := net.JoinHostPort(server, strconv.Itoa(123))
+
+	conn, err := dialNTP(addr, timeout, opts)
+	if err != nil {
+		m := fmt.Sprintf("error connecting: %v\n", err)
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 1
+	}
+	defer func(conn net.Conn) {
+		err := conn.Close()
+		if err != nil {
+			return
+		}
+	}(conn)
+	measuredIP := conn.RemoteAddr().(*net.UDPAddr).IP.String()
+
+	var first map[string]interface{}
+	exchanges := []map[string]interface{}{}
+	var prev map[string]interface{} // previous exchange
+	var prevT1, prevT2, prevT4 uint64
+	serverCookie := uint64(0)
+	interleavedCount := 0
+	requestBytes, responseBytes, responseDatagrams := 0, 0, 0 // all the requests of the series
+	for i := 0; i < samples; i++ {
+		if i > 0 {
+			time.Sleep(300 * time.Millisecond) // do not spam the server
+		}
+		reqOpts := NTPv5RequestOptions{}
+		if prev != nil {
+			reqOpts.Flags = NTPV5_FLAG_INTERLEAVED
+			reqOpts.ServerCookie = serverCookie
+		}
+		req, client_cookie := buildNTPv5RequestWithOptions(draft, reqOpts, &output)
+		output.WriteString(fmt.Sprintf("exchange %d: interleaved requested: %v, server cookie sent: %v\n", i, prev != nil, reqOpts.ServerCookie))
+		ex, code, err := sendAndReceive(conn, req, timeout, opts)
+		requestBytes += len(ex.Request)
+		responseBytes += ex.ReceivedBytes
+		responseDatagrams += ex.ReceivedDatagrams
+		if err != nil {
+			m := fmt.Sprintf("exchange %d: %v\n", i, err)
+			output.WriteString(m)
+			if first == nil {
+				error_message["error"] = m
+				return error_message, output.String(), code
+			}
+			break // keep what we have
+		}
+		t1, t4_uint := ex.T1, ex.T4
+		result, err := parseAccordingToRightVersion(ex.Packet, t1, t4_uint, client_cookie, draft, &output)
+		if err != nil {
+			m := fmt.Sprintf("error parsing response: %v\n", err)
+			output.WriteString(m)
+			error_message["error"] = m
+			return error_message, output.String(), 4
+		}
+		if result["version"] != uint8(NTPV5_VERSION) {
+			m := fmt.Sprintf("server answered with NTP version %v, interleaved NTPv5 needs NTPv5\n", result["version"])
+			output.WriteString(m)
+			error_message["error"] = m
+			return error_message, output.String(), 4
+		}
+		if result["client_cookie_valid"] != true {
+			m := fmt.Sprintf("exchange %d: client cookie in the response does not match\n", i)
+			output.WriteString(m)
+			error_message["error"] = m
+			return error_message, output.String(), 4
+		}
+		if first == nil {
+			first = result
+			addExchangeInfo(first, ex)
+		}
+
+		t2 := result["recv_timestamp"].(uint64)
+		t3 := result["tx_timestamp"].(uint64)
+		serverCookie = result["server_cookie"].(uint64)
+		isInterleaved := result["flags_decoded"].(map[string]bool)["interleaved"]
+		exchange := map[string]interface{}{
+			"client_sent_time":     t1,
+			"server_recv_time":     t2,
+			"client_recv_time":     t4_uint,
+			"server_cookie":        serverCookie,
+			"interleaved_response": isInterleaved,
+		}
+		addRawPackets(exchange, ex.Request, ex.Response)
+		addAmplification(exchange, len(ex.Request), ex.ReceivedBytes, ex.ReceivedDatagrams)
+		if isInterleaved && prev != nil {
+			// t3 is the transmit timestamp of the previous response
+			interleavedCount++
+			prev["server_sent_time_interleaved"] = t3
+			offsetNs, rttNs := offsetAndRttNanoseconds(prevT1, prevT2, t3, prevT4)
+			prev["interleaved_offset_ns"], prev["interleaved_rtt_ns"] = offsetNs, rttNs
+			prev["interleaved_offset"], prev["interleaved_rtt"] = float64(offsetNs)/1e9, float64(rttNs)/1e9
+		} else {
+			// basic response, t3 belongs to this exchange
+			exchange["server_sent_time"] = t3
+			exchange["basic_offset"] = result["offset"]
+			exchange["basic_rtt"] = result["rtt"]
+			exchange["basic_offset_ns"] = result["offset_ns"]
+			exchange["basic_rtt_ns"] = result["rtt_ns"]
+		}
+		exchanges = append(exchanges, exchange)
+		prev, prevT1, prevT2, prevT4 = exchange, t1, t2, t4_uint
+	}
+
+	interleaved := map[string]interface{}{
+		"samples":               len(exchanges),
+		"interleaved_responses": interleavedCount,
+		"supported":             interleavedCount > 0,
+		"exchanges":             exchanges,
+		"basic_offset":          exchanges[0]["basic_offset"],
+		"basic_rtt":             exchanges[0]["basic_rtt"],
+	}
+	if v, ok := exchanges[0]["interleaved_offset"]; ok {
+		// same exchange measured in both modes, the difference is the error of the basic transmit timestamp
+		interleaved["interleaved_offset"] = v
+		interleaved["interleaved_rtt"] = exchanges[0]["interleaved_rtt"]
+		diff := exchanges[0]["interleaved_offset_ns"].(int64) - exchanges[0]["basic_offset_ns"].(int64)
+		interleaved["offset_difference_ns"] = diff
+		interleaved["offset_difference"] = float64(diff) / 1e9
+	}
+	first["Host"] = server
+	first["Measured server IP"] = measuredIP
+	addAmplification(first, requestBytes, responseBytes, responseDatagrams)
+	first["interleaved"] = interleaved
+	return first, output.String(), 0
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// In draft NTPv5 the 32-bit reference ID is replaced by a 4096-bit Bloom filter containing the server IDs of all
+// upstream servers. Every server has a random 120-bit server ID. The 120 bits are split into 10 indexes of 12 bits,
+// and every index sets one bit of the filter. The filter is too big for one packet, so the client asks for it in
+// chunks with the Reference IDs Request extension field (offset in the first 2 bytes, the rest is padding) and the
+// server answers with a Reference IDs Response of the same length containing the filter bytes from that offset.
+const (
+	NTPV5_REFID_FILTER_BITS  = 4096
+	NTPV5_REFID_FILTER_BYTES = NTPV5_REFID_FILTER_BITS / 8
+	NTPV5_SERVER_ID_BYTES    = 15 // 120 bits
+	NTPV5_REFID_HASHES       = 10 // number of 12-bit indexes in a server ID
+)
+
+// parseServerID accepts a server ID as 30 hex characters (":" and "-" separators are ignored)
+func parseServerID(s string) ([]byte, error) {
+	clean := strings.NewReplacer(":", "", "-", "", " ", "").Replace(s)
+	id, err := hex.DecodeString(clean)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server ID %q: %v", s, err)
+	}
+	if len(id) != NTPV5_SERVER_ID_BYTES {
+		return nil, fmt.Errorf("invalid server ID %q: it must have %d bytes, not %d", s, NTPV5_SERVER_ID_BYTES, len(id))
+	}
+	return id, nil
+}
+
+// refIDFilterIndexes returns the 10 bit positions that a server ID sets in the Bloom filter
+func refIDFilterIndexes(serverID []byte) []int {
+	indexes := make([]int, 0, NTPV5_REFID_HASHES)
+	for i := 0; i < NTPV5_REFID_HASHES; i++ {
+		value := 0
+		for b := 0; b < 12; b++ {
+			pos := i*12 + b
+			value <<= 1
+			if serverID[pos/8]&(0x80>>(pos%8)) != 0 {
+				value |= 1
+			}
+		}
+		indexes = append(indexes, value)
+	}
+	return indexes
+}
+
+// refIDFilterContains tests if a server ID is (probably) in the filter. False positives are possible, false
+// negatives are not.
+func refIDFilterContains(filter []byte, serverID []byte) bool {
+	for _, idx := range refIDFilterIndexes(serverID) {
+		if filter[idx/8]&(0x80>>(idx%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// refIDFilterPresence returns nil (unknown, null in the JSON output) when the filter is incomplete: the missing
+// bytes are zero, so a server ID could look absent only because its bits were not received
+func refIDFilterPresence(filter []byte, complete bool, serverID []byte) interface{} {
+	if !complete {
+		return nil
+	}
+	return refIDFilterContains(filter, serverID)
+}
+
+func refIDFilterBitsSet(filter []byte) int {
+	count := 0
+	for _, b := range filter {
+		for ; b != 0; b &= b - 1 {
+			count++
+		}
+	}
+	return count
+}
+
+// buildRefIDsRequestField asks for chunkSize bytes of the filter starting at offset
+func buildRefIDsRequestField(offset int, chunkSize int) []byte {
+	body := make([]byte, chunkSize)
+	binary.BigEndian.PutUint16(body[0:2], uint16(offset))
+	return buildExtensionField(NTPV5_EXT_REFIDS_REQUEST, body)
+}
+
+// refIDFilterInfo describes a (possibly incomplete) filter and checks the given server IDs against it
+func refIDFilterInfo(filter []byte, complete bool, serverIDs []string, ownID string) map[string]interface{} {
+	bitsSet := refIDFilterBitsSet(filter)
+	fillRatio := float64(bitsSet) / NTPV5_REFID_FILTER_BITS
+	info := map[string]interface{}{
+		"filter":     hex.EncodeToString(filter),
+		"complete":   complete,
+		"bits_set":   bitsSet,
+		"fill_ratio": fillRatio,
+		// probability that a random server ID which is not in the filter is still reported as present
+		"false_positive_rate": math.Pow(fillRatio, NTPV5_REFID_HASHES),
+	}
+	if fillRatio < 1 {
+		// standard estimation of the number of elements in a Bloom filter
+		info["estimated_ids"] = -float64(NTPV5_REFID_FILTER_BITS) / NTPV5_REFID_HASHES * math.Log(1-fillRatio)
+	}
+	checked := []map[string]interface{}{}
+	for _, s := range serverIDs {
+		id, _ := parseServerID(s) //already validated in main
+		checked = append(checked, map[string]interface{}{
+			"server_id": hex.EncodeToString(id),
+			"present":   refIDFilterPresence(filter, complete, id),
+		})
+	}
+	if len(checked) > 0 {
+		info["checked_ids"] = checked
+	}
+	if ownID != "" {
+		id, _ := parseServerID(ownID)
+		present := refIDFilterPresence(filter, complete, id)
+		info["own_id"] = hex.EncodeToString(id)
+		info["own_id_present"] = present
+		// if our own ID is upstream of this server, synchronizing to it would create a loop (nil: unknown)
+		info["loop_detected"] = present
+	}
+	return info
+}
+
+// performNTPv5RefIDsMeasurement retrieves the full Reference IDs Bloom filter of an NTPv5 server, using as many
+// requests as needed (chunkSize bytes per request). The returned result is the one of the first response, with the
+// filter information in "ref_ids". If the server did not send (all of) the filter, "complete" is false and a warning
+// is added to the result.
+func performNTPv5RefIDsMeasurement(server string, timeout float64, draft string, chunkSize int,
+	serverIDs []string, ownID string, opts MeasurementOptions) (map[string]interface{}, string, int) {
+
+	var output strings.Builder
+	error_message := map[string]interface{}{}
+	addr := net.JoinHostPort(server, strconv.Itoa(123))
+
+	conn, err := dialNTP(addr, timeout, opts)
+	if err != nil {
+		m := fmt.Sprintf("error connecting: %v\n", err)
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 1
+	}
+	defer func() {
+		if conn == nil {
+			return // a new socket could not be opened
+		}
+		err := conn.Close()
+		if err != nil {
+			return
+		}
+	}()
+	measuredIP := conn.RemoteAddr().(*net.UDPAddr).IP.String()
+
+	filter := make([]byte, NTPV5_REFID_FILTER_BYTES)
+	var first map[string]interface{}
+	requests, received, filled := 0, 0, 0
+	requestBytes, responseBytes, responseDatagrams := 0, 0, 0 // all the requests of the series
+	for offset := 0; offset < NTPV5_REFID_FILTER_BYTES; offset += chunkSize {
+		if requests > 0 {
+			time.Sleep(200 * time.Millisecond) // do not spam the server
+			if opts.Privacy {
+				// a fresh random source port for every request
+				_ = conn.Close()
+				conn, err = dialNTP(addr, timeout, opts)
+				if err != nil {
+					m := fmt.Sprintf("error connecting: %v\n", err)
+					output.WriteString(m)
+					error_message["error"] = m
+					return error_message, output.String(), 1
+				}
+			}
+		}
+		req, client_cookie := buildNTPv5RequestWithOptions(draft, NTPv5RequestOptions{
+			Extensions: [][]byte{buildRefIDsRequestField(offset, chunkSize)},
+		}, &output)
+		output.WriteString(fmt.Sprintf("requesting reference IDs from offset %d (%d bytes), packet size: %d bytes\n", offset, chunkSize, len(req)))
+		requests++
+		ex, code, err := sendAndReceive(conn, req, timeout, opts)
+		requestBytes += len(ex.Request)
+		responseBytes += ex.ReceivedBytes
+		responseDatagrams += ex.ReceivedDatagrams
+		if err != nil {
+			m := fmt.Sprintf("%v\n", err)
+			output.WriteString(m)
+			error_message["error"] = m
+			return error_message, output.String(), code
+		}
+		t1, t4_uint := ex.T1, ex.T4
+		result, err := parseAccordingToRightVersion(ex.Packet, t1, t4_uint, client_cookie, draft, &output)
+		if err != nil {
+			m := fmt.Sprintf("error parsing response: %v\n", err)
+			output.WriteString(m)
+			error_message["error"] = m
+			return error_message, output.String(), 4
+		}
+		if result["version"] != uint8(NTPV5_VERSION) {
+			m := fmt.Sprintf("server answered with NTP version %v, reference IDs need NTPv5\n", result["version"])
+			output.WriteString(m)
+			error_message["error"] = m
+			return error_message, output.String(), 4
+		}
+		if first == nil {
+			first = result
+			addExchangeInfo(first, ex)
+		}
+		if result["client_cookie_valid"] != true {
+			output.WriteString("client cookie in the response does not match, ignoring this chunk\n")
+			break
+		}
+		chunk, ok := findExtensionField(result, NTPV5_EXT_REFIDS_RESPONSE)
+		if !ok {
+			output.WriteString("no Reference IDs Response in the answer\n")
+			break
+		}
+		if len(chunk) != chunkSize {
+			// the response has the length of the request, anything else would shift the filter bytes
+			output.WriteString(fmt.Sprintf("Reference IDs Response of %d bytes instead of %d, ignoring this chunk\n", len(chunk), chunkSize))
+			break
+		}
+		filled += copy(filter[offset:], chunk)
+		received++
+	}
+
+	complete := received == requests && filled >= NTPV5_REFID_FILTER_BYTES
+	first["Host"] = server
+	first["Measured server IP"] = measuredIP
+	addAmplification(first, requestBytes, responseBytes, responseDatagrams)
+	refIDs := refIDFilterInfo(filter, complete, serverIDs, ownID)
+	refIDs["chunk_size"] = chunkSize
+	refIDs["requests_sent"] = requests
+	refIDs["chunks_received"] = received
+	first["ref_ids"] = refIDs
+	if !complete {
+		m := "the server did not send the complete reference IDs filter, presence checks are not reliable"
+		output.WriteString(m + "\n")
+		first["warning"] = m
+	}
+	return first, output.String(), 0
+}
@@ -4,7 +4,6 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
-	"os"
 	"strings"
 	"time"
 
@@ -30,15 +29,6 @@ import (
 
 //So 0 and 6 mean the measurement succeeded. (6 has a warning)
 
-var usage_info_for_nts = `If you want to use NTS commands, you can use:
-	<host>
-    <host> <timeout_s>
-    <host_ip>
-    <host_ip> <timeout_s>
-    <host> ipv4/ipv6     (what IP type you want if possible. If not, you will get the type that is available for NTS)
-    <host> ipv4/ipv6 <timeout_s>
-`
-
 /*
 Return codes for measuring NTS:
 
@@ -55,59 +45,51 @@ OBS: if you measure directly an IP, then the TLS certificate is not validated (b
 	which domain name this IP belongs)
 */
 
-func measureNTS(host string, ipvType string, timeout float64) {
-	//args := os.Args[1:] args []string
+const NTS_WRONG_IP_FAMILY = 6
 
-	//if len(args) < 1 || len(args) > 3 {
-	//	fmt.Println("invalid nts commands")
-	//	fmt.Println(usage_info_for_nts)
-	//	os.Exit(-100)
-	//}
+// ntsSucceeded tells if an NTS return code comes with a measurement (0, or 6 with a warning)
+func ntsSucceeded(code int) bool {
+	return code == 0 || code == NTS_WRONG_IP_FAMILY
+}
+
+// performNTSMeasurement measures a domain name or an IP address with NTS. ipvType ("", "4" or "6") is the IP family
+// wanted: if the domain name works with NTS, but not on that family, the result of the other one is returned with
+// code 6 and a warning
+func performNTSMeasurement(host string, ipvType string, timeout float64) (map[string]interface{}, string, int) {
 	if ipvType == "" { //user does not want a specific IP type (ipv4 or ipv6)
-		is_ip := net.ParseIP(host)
-		result, err_code := "", 0
-		if is_ip == nil { //is a domain name
-			result, err_code = measureDomainName(host, timeout)
-		} else { //is an IP address
-			result, err_code = measureSpecificIP(host, timeout)
+		if net.ParseIP(host) == nil { //is a domain name
+			return measureDomainName(host, timeout)
 		}
-		fmt.Println(result)
-		os.Exit(err_code)
+		return measureSpecificIP(host, timeout) //is an IP address
 	} else if ipvType == "4" || ipvType == "6" { //user wants a specific IP type
 		//firstly test if this domain name is NTS. Then try to get the wanted IP
-		result, err_code := measureDomainName(host, timeout)
-		if err_code == 0 {
-			//now we now the domain name is NTS. Try to get the wanted IP family
-			//wait a bit to not scary the NTS server
-			time.Sleep(600 * time.Millisecond)
-			result_ip_family, err_code_ip_family := measureDomainNameWithIPFamily(host, ipvType, timeout)
-			if err_code_ip_family == 0 {
-				//success, we got the wanted IP family
-				fmt.Println(result_ip_family)
-				os.Exit(err_code_ip_family)
-			} else {
-				//fail. return the initial result
-				//fmt.Print("Wanted ip type failed.\n")
-				fmt.Println(result)
-				os.Exit(6)
-			}
-		} else {
+		result, debug, err_code := measureDomainName(host, timeout)
+		if err_code != 0 {
 			//the domain name is not NTS
-			fmt.Println(result)
-			os.Exit(err_code)
+			return result, debug, err_code
 		}
+		//now we now the domain name is NTS. Try to get the wanted IP family
+		//wait a bit to not scary the NTS server
+		time.Sleep(600 * time.Millisecond)
+		result_ip_family, debug_ip_family, err_code_ip_family := measureDomainNameWithIPFamily(host, ipvType, timeout)
+		if err_code_ip_family == 0 {
+			//success, we got the wanted IP family
+			return result_ip_family, debug + debug_ip_family, err_code_ip_family
+		}
+		//fail. return the initial result
+		result["warning"] = fmt.Sprintf("NTS works, but not on IPv%s: %v", ipvType, result_ip_family["error"])
+		return result, debug + debug_ip_family, NTS_WRONG_IP_FAMILY
 	}
 	//invalid command
-	//result, err_code := measureSpecificIP(args[0])
-	fmt.Println("invalid commands")
-	fmt.Println(usage_info_for_nts)
-	os.Exit(-100)
+	m := fmt.Sprintf("invalid IP family %q (4 or 6)\n", ipvType)
+	return map[string]interface{}{"error": m}, m, -100
 }
 
-func measureDomainNameWithIPFamily(hostname string, ip_family string, timeout float64) (string, int) {
+func measureDomainNameWithIPFamily(hostname string, ip_family string, timeout float64) (map[string]interface{}, string, int) {
 	//ip_family is the IP family that you would prefer to get. If the request cannot be fulfilled, then it will return
 	//the IP family that works (or none)
 	var output strings.Builder
+	error_message := map[string]interface{}{}
 	dialer := &net.Dialer{
 		Timeout: time.Duration(timeout) * time.Second,
 	}
@@ -126,47 +108,63 @@ func measureDomainNameWithIPFamily(hostname string, ip_family string, timeout fl
 		},
 		Timeout: time.Duration(timeout) * time.Second, //a bit redundant as it is also included in Dialer (but is safe)
 		Dialer: func(_, addr string, tlsConfig *tls.Config) (*tls.Conn, error) {
-			return tls.DialWithDialer(dialer, network, addr, tlsConfig)
+			return ntsKEDial(dialer, network, addr, tlsConfig)
 		},
 	})
 
 	if err != nil {
-		return fmt.Sprintf("NTSS session could not be established: key exchange failure %v\n", err.Error()), 1
+		m := fmt.Sprintf("NTSS session could not be established: key exchange failure %v\n", err.Error())
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 1
 	}
 
 	measured_host_ip, port, err := net.SplitHostPort(session.Address())
 	if err != nil {
-		return fmt.Sprintf("Could not deduct NTP host and port: %v\n", err.Error()), 2
+		m := fmt.Sprintf("Could not deduct NTP host and port: %v\n", err.Error())
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 2
 	}
 	//output.WriteString(fmt.Sprintf("Address family: %s\n", ip_family))
 
-	return run_query_and_build_nts_result(&output, hostname, measured_host_ip, port, session, timeout)
+	return run_query_and_build_nts_result(&output, hostname, measured_host_ip, port, session, timeout, false)
 }
 
-func measureDomainName(hostname string, timeout float64) (string, int) {
+func measureDomainName(hostname string, timeout float64) (map[string]interface{}, string, int) {
 
 	var output strings.Builder
+	error_message := map[string]interface{}{}
 	//session, err := nts.NewSession(hostname)
 	session, err := nts.NewSessionWithOptions(hostname, &nts.SessionOptions{
 		Timeout: time.Duration(timeout) * time.Second,
+		Dialer: func(network, addr string, tlsConfig *tls.Config) (*tls.Conn, error) {
+			return ntsKEDial(&net.Dialer{Timeout: time.Duration(timeout) * time.Second}, network, addr, tlsConfig)
+		},
 	})
 	if err != nil {
-		return fmt.Sprintf("NTS session could not be established: key exchange failure %v\n", err.Error()), 1
+		m := fmt.Sprintf("NTS session could not be established: key exchange failure %v\n", err.Error())
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 1
 	}
 
 	measured_host_ip, port, err := net.SplitHostPort(session.Address())
 	if err != nil {
-		output.WriteString(fmt.Sprintf("Could not deduct NTP host and port: %v\n", err.Error()))
-		return output.String(), 2
+		m := fmt.Sprintf("Could not deduct NTP host and port: %v\n", err.Error())
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 2
 	}
 
-	return run_query_and_build_nts_result(&output, hostname, measured_host_ip, port, session, timeout)
+	return run_query_and_build_nts_result(&output, hostname, measured_host_ip, port, session, timeout, false)
 
 }
 
-func measureSpecificIP(ip string, timeout float64) (string, int) {
+func measureSpecificIP(ip string, timeout float64) (map[string]interface{}, string, int) {
 
 	var output strings.Builder
+	error_message := map[string]interface{}{}
 	session, err := nts.NewSessionWithOptions(ip, &nts.SessionOptions{
 		TLSConfig: &tls.Config{
 			ServerName:         ip,
@@ -175,32 +173,43 @@ func measureSpecificIP(ip string, timeout float64) (string, int) {
 		},
 		Timeout: time.Duration(timeout) * time.Second,
 		Dialer: func(network, addr string, tlsConfig *tls.Config) (*tls.Conn, error) {
-			return tls.Dial("tcp", ip+":4460", tlsConfig)
+			return ntsKEDial(&net.Dialer{}, "tcp", ip+":4460", tlsConfig)
 		},
 	})
 	if err != nil {
-		return "NTS session could not be established: key exchange failure\n", 1
+		m := "NTS session could not be established: key exchange failure\n"
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 1
 	}
 	measured_host_ip, port, _ := net.SplitHostPort(session.Address())
 
-	if measured_host_ip != ip {
+	ke_wants_diff_ip := measured_host_ip != ip
+	if ke_wants_diff_ip {
 		//output.WriteString(fmt.Sprintf("different_IP: True\n"))
 		output.WriteString(fmt.Sprintf("Warning: KE wanted a different IP:%s? True\n", measured_host_ip))
 	}
 
-	return run_query_and_build_nts_result(&output, ip, measured_host_ip, port, session, timeout)
+	return run_query_and_build_nts_result(&output, ip, measured_host_ip, port, session, timeout, ke_wants_diff_ip)
 }
 
 func run_query_and_build_nts_result(output *strings.Builder, host string, measured_host_ip string, port string,
-	session *nts.Session, timeout float64) (string, int) {
+	session *nts.Session, timeout float64, ke_wants_diff_ip bool) (map[string]interface{}, string, int) {
 
+	error_message := map[string]interface{}{}
 	t1_time := time.Now() //nowToNtpUint64()
-	r, err := safeQueryWithOptions(session, timeout)
+	r, capture, err := safeQueryWithOptions(session, timeout)
 	if err != nil {
-		return fmt.Sprintf("KE succeeded, but measurement failed: %v\n", err), 3
+		m := fmt.Sprintf("KE succeeded, but measurement failed: %v\n", err)
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 3
 	}
 	if r == nil {
-		return fmt.Sprintf("KE succeeded, but measurement failed. Received null or a too short response\n"), 3
+		m := "KE succeeded, but measurement failed. Received null or a too short response\n"
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 3
 
 	}
 	//r, err := session.QueryWithOptions(&ntp.QueryOptions{
@@ -213,8 +222,6 @@ func run_query_and_build_nts_result(output *strings.Builder, host string, measur
 	t3_time := r.Time
 	t2_time := t1_time.Add((t3_time.Sub(t4_time) + 2*r.ClockOffset))
 
-	ke_wants_diff_ip_str := output.String() //get the info about different IP requested by Key Exchange (KE)
-	output.Reset()
 	//output.WriteString(fmt.Sprintf("Host: %s\n", host))
 	//output.WriteString(fmt.Sprintf("Measured server IP: %s\n", measured_host_ip)) //do not change "Measured server IP". See nts_check.py if you want to change it.
 	//output.WriteString(fmt.Sprintf("Measured server port: %s\n", port))
@@ -254,6 +261,8 @@ func run_query_and_build_nts_result(output *strings.Builder, host string, measur
 		"client_recv_time":     timeToNtpUint64(t4_time),
 		"rtt":                  r.RTT.Seconds(),
 		"offset":               r.ClockOffset.Seconds(),
+		"rtt_ns":               r.RTT.Nanoseconds(),
+		"offset_ns":            r.ClockOffset.Nanoseconds(),
 		"precision":            r.Precision.Seconds(),
 		"stratum":              r.Stratum,
 		"mode":                 4,
@@ -267,7 +276,19 @@ func run_query_and_build_nts_result(output *strings.Builder, host string, measur
 		"minError":             r.MinError.Seconds(),
 		//"NTS_analysis":         "",
 	}
-	if ke_wants_diff_ip_str != "" {
+	if capture != nil && len(capture.sent) > 0 && len(capture.received) > 0 {
+		addRawPackets(info, capture.sent[len(capture.sent)-1], capture.received[len(capture.received)-1])
+		// NTS UDP packets only (the NTS-KE handshake is over TCP and cannot be used for amplification)
+		requestBytes, responseBytes := 0, 0
+		for _, p := range capture.sent {
+			requestBytes += len(p)
+		}
+		for _, p := range capture.received {
+			responseBytes += len(p)
+		}
+		addAmplification(info, requestBytes, responseBytes, len(capture.received))
+	}
+	if ke_wants_diff_ip {
 		//this can be seen when measuring a specific IP address, but the results are shown with another IP
 		info["warning_KE_wanted_diff_ip"] = "The measurement succeeded, but KE redirected us to another IP"
 	}
@@ -276,27 +297,50 @@ func run_query_and_build_nts_result(output *strings.Builder, host string, measur
 	//if everything is fine -> return the data with code 0
 	//else -> return the error message with the specific error code
 	if err != nil {
-		output.WriteString(fmt.Sprintf("Invalid NTP response received: %v\n", err.Error()))
+		m := fmt.Sprintf("Invalid NTP response received: %v\n", err.Error())
+		output.WriteString(m)
+		error_message["error"] = m
 		//info["NTS_analysis"] = fmt.Sprintf("Invalid NTP response received: %v\n", err.Error())
-		return output.String(), 4
+		return error_message, output.String(), 4
 	}
 
 	if r.KissCode != "" {
-		output.WriteString(fmt.Sprintf("KE succeeded, but KissCode: %s\n", r.KissCode))
+		m := fmt.Sprintf("KE succeeded, but KissCode: %s\n", r.KissCode)
+		output.WriteString(m)
+		error_message["error"] = m
 		//info["NTS_analysis"] = fmt.Sprintf("KE succeeded, but KissCode: %s\n", r.KissCode)
-		return output.String(), 5
+		return error_message, output.String(), 5
 	}
-	//fmt.Println(output.String())
-	var json_output strings.Builder
-	//json_output.WriteString(output.String())
-	//json_output.WriteString("\n")
 	//info["NTS_analysis"] = "Measurement succeeded!"
-	jsonToString(info, &json_output)
-	return json_output.String(), 0
+	return info, output.String(), 0
+}
+
+// capturingConn remembers the datagrams written and read through a connection, to see the NTS packets that are built
+// and parsed by the library
+type capturingConn struct {
+	net.Conn
+	sent     [][]byte
+	received [][]byte
+}
+
+func (c *capturingConn) Write(b []byte) (int, error) {
+	c.sent = append(c.sent, append([]byte(nil), b...))
+	pcapRecordNTP(c.Conn, c.Conn.RemoteAddr(), true, b, time.Now(), "NTS")
+	return c.Conn.Write(b)
 }
 
-func safeQueryWithOptions(session *nts.Session, timeout float64) (*ntp.Response, error) {
+func (c *capturingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.received = append(c.received, append([]byte(nil), b[:n]...))
+		pcapRecordNTP(c.Conn, c.Conn.RemoteAddr(), false, b[:n], time.Now(), "NTS")
+	}
+	return n, err
+}
+
+func safeQueryWithOptions(session *nts.Session, timeout float64) (*ntp.Response, *capturingConn, error) {
 	var r *ntp.Response
+	var capture *capturingConn
 	var err error
 
 	defer func() {
@@ -308,11 +352,19 @@ func safeQueryWithOptions(session *nts.Session, timeout float64) (*ntp.Response,
 
 	r, err = session.QueryWithOptions(&ntp.QueryOptions{
 		Timeout: time.Duration(timeout) * time.Second,
+		Dialer: func(localAddress, remoteAddress string) (net.Conn, error) {
+			conn, err := net.Dial("udp", remoteAddress)
+			if err != nil {
+				return nil, err
+			}
+			capture = &capturingConn{Conn: conn}
+			return capture, nil
+		},
 	})
 
 	if r == nil && err == nil {
 		err = fmt.Errorf("NTS query returned nil response")
 	}
 
-	return r, err
+	return r, capture, err
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aead/cmac"
+)
+
+// Symmetric key authentication of NTPv3/NTPv4 (RFC 5905 and RFC 8573). The request is followed by a MAC: the key ID
+// (4 bytes) and the digest of the packet. MD5 and SHA1 digests are hash(key || packet) (16 and 20 bytes), AES-CMAC
+// is the CMAC of the packet with AES-128 (16 bytes). The server answers with a MAC made with the same key, or with a
+// crypto-NAK (only a key ID of 0) if it does not know the key or the MAC of the request is wrong.
+//
+// Keys are read from an ntp.keys file as used by ntpd and chrony: one key per line, "<id> <type> <key>", where keys
+// of up to 20 characters are ASCII and longer ones are hex (ntpd rule), and "#" starts a comment.
+
+const (
+	AUTH_MD5  = "MD5"
+	AUTH_SHA1 = "SHA1"
+	AUTH_CMAC = "AES128CMAC"
+
+	AUTH_KEY_ID_SIZE = 4
+	AUTH_CMAC_KEY    = 16
+
+	// results of the verification of a response
+	AUTH_STATUS_AUTHENTICATED = "authenticated"
+	AUTH_STATUS_CRYPTO_NAK    = "crypto_nak"    // the server rejected our key or MAC
+	AUTH_STATUS_MISSING_MAC   = "missing_mac"   // the response is not authenticated
+	AUTH_STATUS_BAD_MAC       = "bad_mac"       // the digest does not match (wrong key or altered packet)
+	AUTH_STATUS_WRONG_KEY_ID  = "wrong_key_id"  // the server used another key
+	AUTH_STATUS_MALFORMED_MAC = "malformed_mac" // the bytes after the header are not a MAC of our type
+	AUTH_STATUS_NOT_SUPPORTED = "not_supported" // only NTPv3 and NTPv4 requests are authenticated
+)
+
+// ntpKey is a symmetric key of a keys file
+type ntpKey struct {
+	ID   uint32
+	Type string // AUTH_MD5, AUTH_SHA1 or AUTH_CMAC
+	Key  []byte
+}
+
+// digestSize is the size of the digest of the MAC (without the key ID)
+func (k *ntpKey) digestSize() int {
+	if k.Type == AUTH_SHA1 {
+		return sha1.Size
+	}
+	return 16 // MD5 and AES-CMAC
+}
+
+func (k *ntpKey) digest(packet []byte) []byte {
+	switch k.Type {
+	case AUTH_SHA1:
+		sum := sha1.Sum(append(append([]byte{}, k.Key...), packet...))
+		return sum[:]
+	case AUTH_CMAC:
+		// like ntpd, a shorter key is padded with zeros and a longer one is truncated
+		key := make([]byte, AUTH_CMAC_KEY)
+		copy(key, k.Key)
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil
+		}
+		sum, err := cmac.Sum(packet, block, block.BlockSize())
+		if err != nil {
+			return nil
+		}
+		return sum
+	default:
+		sum := md5.Sum(append(append([]byte{}, k.Key...), packet...))
+		return sum[:]
+	}
+}
+
+// parseKeyType accepts the names used by ntpd and chrony
+func parseKeyType(name string) (string, error) {
+	switch strings.ToUpper(name) {
+	case "M", "MD5":
+		return AUTH_MD5, nil
+	case "SHA1", "SHA-1":
+		return AUTH_SHA1, nil
+	case "AES128CMAC", "AES-128-CMAC", "CMAC", "AES128":
+		return AUTH_CMAC, nil
+	}
+	return "", fmt.Errorf("unsupported key type %q (MD5, SHA1 or AES128CMAC)", name)
+}
+
+// loadKey reads the key with the given ID from an ntp.keys file
+func loadKey(path string, id uint32) (*ntpKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the keys file: %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s:%d: expected \"<id> <type> <key>\"", path, lineNumber)
+		}
+		keyID, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil || keyID == 0 {
+			return nil, fmt.Errorf("%s:%d: invalid key ID %q", path, lineNumber, fields[0])
+		}
+		if uint32(keyID) != id {
+			continue
+		}
+		keyType, err := parseKeyType(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNumber, err)
+		}
+		key := []byte(fields[2])
+		if len(fields[2]) > 20 {
+			key, err = hex.DecodeString(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: keys longer than 20 characters must be hex: %v", path, lineNumber, err)
+			}
+		}
+		return &ntpKey{ID: id, Type: keyType, Key: key}, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read the keys file: %v", err)
+	}
+	return nil, fmt.Errorf("key %d not found in %s", id, path)
+}
+
+// authenticatedVersion tells if requests of this version carry a MAC (NTPv3 and NTPv4)
+func authenticatedVersion(packet []byte) bool {
+	version := (packet[0] >> 3) & 0x7
+	return version == 3 || version == 4
+}
+
+// appendMAC returns a copy of the request followed by the key ID and the digest
+func appendMAC(req []byte, key *ntpKey) []byte {
+	mac := make([]byte, AUTH_KEY_ID_SIZE)
+	binary.BigEndian.PutUint32(mac, key.ID)
+	authenticated := append(append([]byte{}, req...), mac...)
+	return append(authenticated, key.digest(req)...)
+}
+
+// verifyMAC checks the MAC at the end of a response and describes the result. It also returns the response without
+// the MAC (or crypto-NAK) when it was recognized, so that the parsers do not take it for extension fields.
+func verifyMAC(resp []byte, key *ntpKey) (map[string]interface{}, []byte) {
+	info := map[string]interface{}{
+		"key_id":    key.ID,
+		"algorithm": key.Type,
+	}
+	macSize := AUTH_KEY_ID_SIZE + key.digestSize()
+	packet := resp
+	trailing := len(resp) - NTP_PACKET_SIZE
+	switch {
+	case trailing <= 0:
+		info["status"] = AUTH_STATUS_MISSING_MAC
+	case trailing == AUTH_KEY_ID_SIZE && binary.BigEndian.Uint32(resp[NTP_PACKET_SIZE:]) == 0:
+		info["status"] = AUTH_STATUS_CRYPTO_NAK
+		packet = resp[:NTP_PACKET_SIZE]
+	case trailing < macSize:
+		info["status"] = AUTH_STATUS_MALFORMED_MAC
+	default:
+		// extension fields (if any) are between the header and the MAC, which is always at the end
+		mac := resp[len(resp)-macSize:]
+		responseKeyID := binary.BigEndian.Uint32(mac)
+		info["response_key_id"] = responseKeyID
+		if responseKeyID != key.ID {
+			info["status"] = AUTH_STATUS_WRONG_KEY_ID
+		} else if hmac.Equal(mac[AUTH_KEY_ID_SIZE:], key.digest(resp[:len(resp)-macSize])) {
+			info["status"] = AUTH_STATUS_AUTHENTICATED
+			packet = resp[:len(resp)-macSize]
+		} else {
+			// our key ID and a digest of the right size: a MAC, even if it does not match
+			info["status"] = AUTH_STATUS_BAD_MAC
+			packet = resp[:len(resp)-macSize]
+		}
+	}
+	info["authenticated"] = info["status"] == AUTH_STATUS_AUTHENTICATED
+	return info, packet
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Packet crafting ("craft" mode), for research: every header field and any extension field of the request can be
+// set, the request is sent and the response is decoded like in the other modes. The fields come from a JSON template
+// (-template, a file or inline JSON) and/or from "-set field=value,field=value". The fields that are not given keep
+// the value of the normal request of that version (so an empty template sends the same request as "ntpv4").
+//
+// Template fields:
+//   - version, leap, mode, stratum, poll, precision
+//   - root_delay, root_disp (seconds)
+//   - ref_id (NTPv1-v4): "0x01020304", an IPv4 address or up to 4 ASCII characters (like "GPS")
+//   - ref_timestamp, orig_timestamp (NTPv1-v4), recv_timestamp, tx_timestamp: 64-bit NTP timestamps as a number,
+//     "0x..." hex, "now", "random" or an RFC 3339 time
+//   - timescale, era, flags, server_cookie, client_cookie (NTPv5, the layout follows -draft)
+//   - extensions: list of {"type": 62721, "data": "<hex>", "length": <optional, to send a wrong length>}
+
+// craftValue is a 64-bit value given in the template as a JSON number (without float rounding), "0x..." hex, or, for
+// timestamps, "now", "random" or an RFC 3339 time.
+type craftValue string
+
+func (v *craftValue) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*v = craftValue(s)
+		return nil
+	}
+	*v = craftValue(strings.TrimSpace(string(data)))
+	return nil
+}
+
+// uint64Value converts the value; "now", "random" and times are only accepted for timestamps
+func (v craftValue) uint64Value(timestamp bool) (uint64, error) {
+	s := string(v)
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		return strconv.ParseUint(s[2:], 16, 64)
+	}
+	if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return n, nil
+	}
+	if timestamp {
+		if s == "now" {
+			return nowToNtpUint64(), nil
+		}
+		if s == "random" {
+			return rand.Uint64(), nil // like the clients that hide their clock in the transmit timestamp
+		}
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return timeToNtpUint64(t), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid value %q", s)
+}
+
+type craftExtension struct {
+	Type   uint16 `json:"type"`
+	Data   string `json:"data"`   // hex
+	Length *int   `json:"length"` // length written in the field (default: the real one)
+}
+
+type craftTemplate struct {
+	Version       *uint8           `json:"version"`
+	Leap          *uint8           `json:"leap"`
+	Mode          *uint8           `json:"mode"`
+	Stratum       *uint8           `json:"stratum"`
+	Poll          *int8            `json:"poll"`
+	Precision     *int8            `json:"precision"`
+	RootDelay     *float64         `json:"root_delay"`
+	RootDisp      *float64         `json:"root_disp"`
+	RefID         *string          `json:"ref_id"`
+	RefTimestamp  *craftValue      `json:"ref_timestamp"`
+	OrigTimestamp *craftValue      `json:"orig_timestamp"`
+	RecvTimestamp *craftValue      `json:"recv_timestamp"`
+	TxTimestamp   *craftValue      `json:"tx_timestamp"`
+	Timescale     *uint8           `json:"timescale"`
+	Era           *uint8           `json:"era"`
+	Flags         *uint16          `json:"flags"`
+	ServerCookie  *craftValue      `json:"server_cookie"`
+	ClientCookie  *craftValue      `json:"client_cookie"`
+	Extensions    []craftExtension `json:"extensions"`
+}
+
+// parseCraftTemplate starts from the fields of a client profile (if any), then reads the template (a file name or
+// inline JSON) and applies the "-set" assignments. A value of -set that is not valid JSON is taken as a string.
+func parseCraftTemplate(profile string, template string, set string) (craftTemplate, error) {
+	fields := map[string]json.RawMessage{}
+	if profile != "" {
+		p, ok := clientProfiles[profile]
+		if !ok {
+			return craftTemplate{}, fmt.Errorf("unknown client profile %q (known: %s)", profile, strings.Join(clientProfileNames(), ", "))
+		}
+		_ = json.Unmarshal([]byte(p.template), &fields)
+	}
+	if template != "" {
+		data := []byte(template)
+		if !strings.HasPrefix(strings.TrimSpace(template), "{") {
+			fileData, err := os.ReadFile(template)
+			if err != nil {
+				return craftTemplate{}, fmt.Errorf("could not read the template: %v", err)
+			}
+			data = fileData
+		}
+		templateFields := map[string]json.RawMessage{}
+		if err := json.Unmarshal(data, &templateFields); err != nil {
+			return craftTemplate{}, fmt.Errorf("invalid template: %v", err)
+		}
+		for key, value := range templateFields {
+			fields[key] = value
+		}
+	}
+	if set != "" {
+		for _, assignment := range strings.Split(set, ",") {
+			key, value, found := strings.Cut(assignment, "=")
+			if !found {
+				return craftTemplate{}, fmt.Errorf("invalid -set %q, it must be field=value", assignment)
+			}
+			raw := json.RawMessage(value)
+			if !json.Valid(raw) {
+				raw, _ = json.Marshal(value)
+			}
+			fields[strings.TrimSpace(key)] = raw
+		}
+	}
+	var t craftTemplate
+	allowed := map[string]bool{}
+	for _, name := range []string{"version", "leap", "mode", "stratum", "poll", "precision", "root_delay", "root_disp",
+		"ref_id", "ref_timestamp", "orig_timestamp", "recv_timestamp", "tx_timestamp", "timescale", "era", "flags",
+		"server_cookie", "client_cookie", "extensions"} {
+		allowed[name] = true
+	}
+	for key := range fields {
+		if !allowed[key] {
+			return t, fmt.Errorf("unknown template field %q", key)
+		}
+	}
+	merged, _ := json.Marshal(fields)
+	if err := json.Unmarshal(merged, &t); err != nil {
+		return t, fmt.Errorf("invalid template: %v", err)
+	}
+	if t.Leap != nil && *t.Leap > 3 || t.Version != nil && *t.Version > 7 || t.Mode != nil && *t.Mode > 7 {
+		return t, fmt.Errorf("leap must be 0-3, version and mode 0-7")
+	}
+	return t, nil
+}
+
+// secondsToTime32 is the inverse of time32ToSeconds (16.16 fixed point)
+func secondsToTime32(seconds float64) uint32 {
+	return uint32(math.Round(seconds * 65536))
+}
+
+// parseRefID accepts "0x..." hex, an IPv4 address or up to 4 ASCII characters
+func parseRefID(s string) (uint32, error) {
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		v, err := strconv.ParseUint(s[2:], 16, 32)
+		return uint32(v), err
+	}
+	if ip := net.ParseIP(s).To4(); ip != nil {
+		return binary.BigEndian.Uint32(ip), nil
+	}
+	if len(s) <= 4 {
+		b := make([]byte, 4)
+		copy(b, s)
+		return binary.BigEndian.Uint32(b), nil
+	}
+	return 0, fmt.Errorf("invalid ref_id %q", s)
+}
+
+// buildCraftedRequest starts from the normal request of the version and overwrites the fields of the template
+func buildCraftedRequest(t craftTemplate, draft string, output *strings.Builder) ([]byte, error) {
+	version := uint8(NTPV4_VERSION)
+	if t.Version != nil {
+		version = *t.Version
+	}
+	var req []byte
+	if version == NTPV5_VERSION {
+		req, _ = buildNTPv5Request(draft, output)
+	} else {
+		req, _ = buildNTPv4Request()
+	}
+	header := req[:48]
+	header[0] = header[0]&^(0x7<<3) | version<<3
+	if t.Leap != nil {
+		header[0] = header[0]&0x3F | *t.Leap<<6
+	}
+	if t.Mode != nil {
+		header[0] = header[0]&^0x7 | *t.Mode
+	}
+	if t.Stratum != nil {
+		header[1] = *t.Stratum
+	}
+	if t.Poll != nil {
+		header[2] = byte(*t.Poll)
+	}
+	if t.Precision != nil {
+		header[3] = byte(*t.Precision)
+	}
+
+	// positions of the fields that moved between the layouts
+	rootDelayPos, timescalePos := 4, -1
+	if version == NTPV5_VERSION {
+		rootDelayPos, timescalePos = 8, 4
+		if draft == "draft-ietf-ntp-ntpv5-06" {
+			rootDelayPos, timescalePos = 4, 12
+		}
+	}
+	if t.RootDelay != nil {
+		binary.BigEndian.PutUint32(header[rootDelayPos:rootDelayPos+4], secondsToTime32(*t.RootDelay))
+	}
+	if t.RootDisp != nil {
+		binary.BigEndian.PutUint32(header[rootDelayPos+4:rootDelayPos+8], secondsToTime32(*t.RootDisp))
+	}
+
+	values := []struct {
+		value     *craftValue
+		pos       int
+		timestamp bool
+		v5        bool // the field exists in NTPv5 (true) or in NTPv1-v4 (false)
+		name      string
+	}{
+		{t.RefTimestamp, 16, true, false, "ref_timestamp"},
+		{t.OrigTimestamp, 24, true, false, "orig_timestamp"},
+		{t.ServerCookie, 16, false, true, "server_cookie"},
+		{t.ClientCookie, 24, false, true, "client_cookie"},
+	}
+	for _, f := range values {
+		if f.value == nil {
+			continue
+		}
+		if f.v5 != (version == NTPV5_VERSION) {
+			return nil, fmt.Errorf("%s cannot be used with version %d", f.name, version)
+		}
+		v, err := f.value.uint64Value(f.timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.name, err)
+		}
+		binary.BigEndian.PutUint64(header[f.pos:f.pos+8], v)
+	}
+	for _, f := range []struct {
+		value *craftValue
+		pos   int
+		name  string
+	}{{t.RecvTimestamp, 32, "recv_timestamp"}, {t.TxTimestamp, 40, "tx_timestamp"}} {
+		if f.value == nil {
+			continue
+		}
+		v, err := f.value.uint64Value(true)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.name, err)
+		}
+		binary.BigEndian.PutUint64(header[f.pos:f.pos+8], v)
+	}
+
+	if version == NTPV5_VERSION {
+		if t.Timescale != nil {
+			header[timescalePos] = *t.Timescale
+		}
+		if t.Era != nil {
+			header[timescalePos+1] = *t.Era
+		}
+		if t.Flags != nil {
+			binary.BigEndian.PutUint16(header[timescalePos+2:timescalePos+4], *t.Flags)
+		}
+	} else {
+		if t.Timescale != nil || t.Era != nil || t.Flags != nil {
+			return nil, fmt.Errorf("timescale, era and flags only exist in NTPv5")
+		}
+		if t.RefID != nil {
+			refID, err := parseRefID(*t.RefID)
+			if err != nil {
+				return nil, err
+			}
+			binary.BigEndian.PutUint32(header[12:16], refID)
+		}
+	}
+
+	for i, e := range t.Extensions {
+		body, err := hex.DecodeString(e.Data)
+		if err != nil {
+			return nil, fmt.Errorf("extension %d: invalid hex data: %v", i, err)
+		}
+		ext := buildExtensionField(e.Type, body)
+		if e.Length != nil {
+			binary.BigEndian.PutUint16(ext[2:4], uint16(*e.Length))
+		}
+		req = append(req, ext...)
+	}
+	return req, nil
+}
+
+// performCraftedMeasurement sends the crafted request and decodes the response. Nothing is checked in the response,
+// so "response_matches_request" shows if it answers our request (origin timestamp or client cookie).
+func performCraftedMeasurement(server string, timeout float64, draft string, t craftTemplate, opts MeasurementOptions) (map[string]interface{}, string, int) {
+
+	var output strings.Builder
+	error_message := map[string]interface{}{}
+	// the crafted request is sent exactly as described, privacy mode would rewrite it ("tx_timestamp": "random" hides
+	// the local clock)
+	opts.Privacy = false
+
+	req, err := buildCraftedRequest(t, draft, &output)
+	if err != nil {
+		m := fmt.Sprintf("could not build the request: %v\n", err)
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), -100
+	}
+	output.WriteString(fmt.Sprintf("crafted request (%d bytes):\n", len(req)))
+	printHex4PerLine(req, &output)
+	request, err := parseNTPPacket(req, 0, 0, 0, draft, &output)
+	if err == nil {
+		removeClientFields(request)
+		delete(request, "anomaly") // the checks of the parsers are for responses
+	}
+
+	addr := net.JoinHostPort(server, strconv.Itoa(123))
+	conn, err := dialNTP(addr, timeout, opts)
+	if err != nil {
+		m := fmt.Sprintf("error connecting: %v\n", err)
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 1
+	}
+	defer func(conn net.Conn) {
+		err := conn.Close()
+		if err != nil {
+			return
+		}
+	}(conn)
+
+	ex, code, err := sendAndReceive(conn, req, timeout, opts)
+	if err != nil {
+		m := fmt.Sprintf("%v\n", err)
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), code
+	}
+	result, err := parseNTPPacket(ex.Packet, ex.T1, ex.T4, binary.BigEndian.Uint64(req[24:32]), draft, &output)
+	if err != nil {
+		m := fmt.Sprintf("error parsing response: %v (response: %x)\n", err, ex.Response)
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 4
+	}
+	result["Host"] = server
+	result["Measured server IP"] = conn.RemoteAddr().(*net.UDPAddr).IP.String()
+	if request != nil {
+		result["crafted_request"] = request
+	}
+	result["response_matches_request"] = responseMatchesRequest(req, ex.Response)
+	addExchangeInfo(result, ex)
+	return result, output.String(), 0
+}
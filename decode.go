@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Offline decoding ("decode" command): the input is a hex string, a file with one raw NTP packet or a pcap/pcapng
+// capture. The packets go through the same parsers as the live measurements (parseAccordingToRightVersion), so the
+// output is the same JSON. In a capture, a response is paired with the request it answers: then t1 and t4 are the
+// capture times of the request and of the response, and offset and rtt are computed (they are only meaningful if the
+// capture was taken on the client).
+
+const (
+	PCAP_MAGIC_MICROSECONDS = 0xA1B2C3D4
+	PCAP_MAGIC_NANOSECONDS  = 0xA1B23C4D
+
+	LINKTYPE_NULL       = 0
+	LINKTYPE_ETHERNET   = 1
+	LINKTYPE_RAW        = 101
+	LINKTYPE_LINUX_SLL  = 113
+	LINKTYPE_IPV4       = 228
+	LINKTYPE_IPV6       = 229
+	LINKTYPE_LINUX_SLL2 = 276
+)
+
+// capturedPacket is one frame of a capture, with the link type of its interface
+type capturedPacket struct {
+	time     time.Time
+	linkType uint16
+	data     []byte
+}
+
+// ntpDatagram is a UDP datagram to or from port 123 found in a capture
+type ntpDatagram struct {
+	index    int // frame number in the capture (from 1, as in Wireshark)
+	time     time.Time
+	src, dst *net.UDPAddr
+	payload  []byte
+}
+
+// decodeInput decodes the packets of a hex string, a binary file or a capture. The return values are as in the
+// measurements: the result, the debug output and the code (1 -> the input cannot be read, 4 -> no NTP packet could be
+// parsed).
+func decodeInput(input string, draft string) (map[string]interface{}, string, int) {
+	var output strings.Builder
+	error_message := map[string]interface{}{}
+
+	data, err := os.ReadFile(input)
+	if err != nil {
+		// not a file, so it should be hex
+		clean := strings.NewReplacer(" ", "", ":", "", "\n", "", "\t", "", "0x", "").Replace(input)
+		data, err = hex.DecodeString(clean)
+		if err != nil {
+			m := fmt.Sprintf("input is neither a readable file nor a hex string: %v\n", err)
+			output.WriteString(m)
+			error_message["error"] = m
+			return error_message, output.String(), 1
+		}
+		output.WriteString(fmt.Sprintf("decoding %d bytes from hex\n", len(data)))
+		return decodeSinglePacket(data, draft, &output)
+	}
+
+	packets, isCapture, err := readCapture(data)
+	if !isCapture {
+		output.WriteString(fmt.Sprintf("decoding %d bytes from the raw file %s\n", len(data), input))
+		return decodeSinglePacket(data, draft, &output)
+	}
+	if err != nil {
+		// keep the packets read until the error (the capture may be truncated)
+		output.WriteString(fmt.Sprintf("error reading the capture: %v\n", err))
+	}
+	output.WriteString(fmt.Sprintf("%d frames in the capture %s\n", len(packets), input))
+	return decodeCapture(packets, draft, &output)
+}
+
+// decodeSinglePacket parses one packet. We do not know when it was sent and received, so the fields computed from t1
+// and t4 are removed.
+func decodeSinglePacket(data []byte, draft string, output *strings.Builder) (map[string]interface{}, string, int) {
+	error_message := map[string]interface{}{}
+	result, err := parseNTPPacket(data, 0, 0, 0, draft, output)
+	if err != nil {
+		m := fmt.Sprintf("error parsing packet: %v\n", err)
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 4
+	}
+	removeClientFields(result)
+	result["packet_raw"] = hex.EncodeToString(data)
+	result["packet_size"] = len(data)
+	return result, output.String(), 0
+}
+
+// removeClientFields removes the fields computed from t1, t4 and our client cookie, when we do not know them
+func removeClientFields(result map[string]interface{}) {
+	for _, key := range []string{"offset", "rtt", "offset_ns", "rtt_ns", "client_recv_time", "client_cookie_valid"} {
+		delete(result, key)
+	}
+}
+
+// parseNTPPacket is parseAccordingToRightVersion, but it also accepts packets without version number (NTPv1 as
+// built by this tool)
+func parseNTPPacket(data []byte, t1 uint64, t4 uint64, clientCookie uint64, draft string, output *strings.Builder) (map[string]interface{}, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty packet")
+	}
+	if getNtpVersionInResponse(data) == 0 {
+		return parseNTPv1Response(data, t1, t4)
+	}
+	return parseAccordingToRightVersion(data, t1, t4, clientCookie, draft, output)
+}
+
+// decodeCapture parses all the NTP datagrams of a capture and pairs every response with its request
+func decodeCapture(packets []capturedPacket, draft string, output *strings.Builder) (map[string]interface{}, string, int) {
+	error_message := map[string]interface{}{}
+	datagrams := ntpDatagramsInCapture(packets)
+	output.WriteString(fmt.Sprintf("%d NTP datagrams (UDP port 123)\n", len(datagrams)))
+
+	decoded := []map[string]interface{}{}
+	parsed, pairs := 0, 0
+	for i, d := range datagrams {
+		entry := map[string]interface{}{
+			"frame":        d.index,
+			"capture_time": d.time.UTC().Format(time.RFC3339Nano),
+			"source":       d.src.String(),
+			"destination":  d.dst.String(),
+			"packet_raw":   hex.EncodeToString(d.payload),
+			"packet_size":  len(d.payload),
+		}
+		request := findRequest(datagrams, i)
+		var result map[string]interface{}
+		var err error
+		if request >= 0 {
+			r := datagrams[request]
+			clientCookie := uint64(0)
+			if len(r.payload) >= 32 {
+				clientCookie = binary.BigEndian.Uint64(r.payload[24:32])
+			}
+			result, err = parseNTPPacket(d.payload, timeToNtpUint64(r.time), timeToNtpUint64(d.time), clientCookie, draft, output)
+			if err == nil {
+				result["client_sent_time"] = timeToNtpUint64(r.time)
+				entry["request_frame"] = r.index
+				pairs++
+			}
+		} else {
+			result, err = parseNTPPacket(d.payload, 0, 0, 0, draft, output)
+			if err == nil {
+				removeClientFields(result)
+			}
+		}
+		if err != nil {
+			entry["error"] = err.Error()
+		} else {
+			entry["decoded"] = result
+			parsed++
+		}
+		decoded = append(decoded, entry)
+	}
+	if parsed == 0 {
+		m := fmt.Sprintf("no NTP packet could be parsed (%d frames, %d datagrams to or from port 123)\n", len(packets), len(datagrams))
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 4
+	}
+	return map[string]interface{}{
+		"frames":        len(packets),
+		"ntp_datagrams": len(datagrams),
+		"parsed":        parsed,
+		"matched_pairs": pairs,
+		"packets":       decoded,
+	}, output.String(), 0
+}
+
+// NTP association modes of the packets in a capture (MODE_CLIENT is in NTPv4.go)
+const (
+	MODE_SYMMETRIC_ACTIVE  = 1
+	MODE_SYMMETRIC_PASSIVE = 2
+	MODE_SERVER            = 4
+)
+
+// packetMode returns the mode field of an NTP packet (-1 if it is empty)
+func packetMode(payload []byte) int {
+	if len(payload) == 0 {
+		return -1
+	}
+	return int(payload[0] & 0x7)
+}
+
+// isSymmetricMode tells if a packet is exchanged between two peers (each packet is a request and an answer)
+func isSymmetricMode(mode int) bool {
+	return mode == MODE_SYMMETRIC_ACTIVE || mode == MODE_SYMMETRIC_PASSIVE
+}
+
+// findRequest returns the index of the request that datagram i answers (the last one before it, in the other
+// direction, with our origin timestamp or client cookie), or -1 if there is none. Requests and answers are told apart
+// by the mode, not by the ports (clients like ntpd send from port 123 too): a server response (mode 4) answers a client
+// request (mode 3), a symmetric packet (mode 1 or 2) answers the last symmetric packet of the peer.
+func findRequest(datagrams []ntpDatagram, i int) int {
+	d := datagrams[i]
+	mode := packetMode(d.payload)
+	if mode != MODE_SERVER && !isSymmetricMode(mode) {
+		return -1 // not an answer
+	}
+	for j := i - 1; j >= 0; j-- {
+		r := datagrams[j]
+		requestMode := packetMode(r.payload)
+		if (mode == MODE_SERVER && requestMode != MODE_CLIENT) || (isSymmetricMode(mode) && !isSymmetricMode(requestMode)) {
+			continue
+		}
+		if sameUDPSource(r.src, d.dst) && sameUDPSource(r.dst, d.src) && responseMatchesRequest(r.payload, d.payload) {
+			return j
+		}
+	}
+	return -1
+}
+
+// ntpDatagramsInCapture returns the UDP datagrams to or from port 123
+func ntpDatagramsInCapture(packets []capturedPacket) []ntpDatagram {
+	datagrams := []ntpDatagram{}
+	for i, p := range packets {
+		src, dst, payload, ok := extractUDP(p.linkType, p.data)
+		if !ok || (src.Port != 123 && dst.Port != 123) {
+			continue
+		}
+		datagrams = append(datagrams, ntpDatagram{i + 1, p.time, src, dst, payload})
+	}
+	return datagrams
+}
+
+// readCapture reads a pcap or pcapng file. isCapture is false if the data does not start like a capture.
+func readCapture(data []byte) ([]capturedPacket, bool, error) {
+	if len(data) < 4 {
+		return nil, false, nil
+	}
+	if binary.LittleEndian.Uint32(data[0:4]) == PCAPNG_BLOCK_SHB {
+		packets, err := readPcapng(data)
+		return packets, true, err
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		magic := order.Uint32(data[0:4])
+		if magic == PCAP_MAGIC_MICROSECONDS || magic == PCAP_MAGIC_NANOSECONDS {
+			packets, err := readPcap(data, order, magic == PCAP_MAGIC_NANOSECONDS)
+			return packets, true, err
+		}
+	}
+	return nil, false, nil
+}
+
+// readPcap reads a classic pcap file (24 bytes global header, 16 bytes header per packet)
+func readPcap(data []byte, order binary.ByteOrder, nanoseconds bool) ([]capturedPacket, error) {
+	if len(data) < 24 {
+		return nil, fmt.Errorf("pcap header too short")
+	}
+	linkType := uint16(order.Uint32(data[20:24]))
+	packets := []capturedPacket{}
+	for pos := 24; pos < len(data); {
+		if pos+16 > len(data) {
+			return packets, fmt.Errorf("truncated packet header at byte %d", pos)
+		}
+		sec := int64(order.Uint32(data[pos : pos+4]))
+		frac := int64(order.Uint32(data[pos+4 : pos+8]))
+		capLen := int(order.Uint32(data[pos+8 : pos+12]))
+		pos += 16
+		if pos+capLen > len(data) {
+			return packets, fmt.Errorf("truncated packet at byte %d", pos)
+		}
+		if !nanoseconds {
+			frac *= 1000
+		}
+		packets = append(packets, capturedPacket{time.Unix(sec, frac), linkType, data[pos : pos+capLen]})
+		pos += capLen
+	}
+	return packets, nil
+}
+
+// pcapngInterface keeps what we need from an Interface Description Block
+type pcapngInterface struct {
+	linkType uint16
+	tsUnits  uint64 // timestamp units per second
+}
+
+// readPcapng reads the Enhanced (and Simple) Packet Blocks of a pcapng file. Every section can have its own byte order
+// and interfaces.
+func readPcapng(data []byte) ([]capturedPacket, error) {
+	packets := []capturedPacket{}
+	var order binary.ByteOrder = binary.LittleEndian
+	interfaces := []pcapngInterface{}
+	for pos := 0; pos+12 <= len(data); {
+		if binary.LittleEndian.Uint32(data[pos:pos+4]) == PCAPNG_BLOCK_SHB {
+			// new section: the byte order magic tells the endianness
+			if pos+12 > len(data) {
+				break
+			}
+			if binary.LittleEndian.Uint32(data[pos+8:pos+12]) == PCAPNG_BYTE_ORDER_MAGIC {
+				order = binary.LittleEndian
+			} else {
+				order = binary.BigEndian
+			}
+			interfaces = interfaces[:0]
+		}
+		blockType := order.Uint32(data[pos : pos+4])
+		length := int(order.Uint32(data[pos+4 : pos+8]))
+		if length < 12 || pos+length > len(data) {
+			return packets, fmt.Errorf("invalid block length %d at byte %d", length, pos)
+		}
+		body := data[pos+8 : pos+length-4]
+		switch blockType {
+		case PCAPNG_BLOCK_IDB:
+			if len(body) >= 8 {
+				iface := pcapngInterface{linkType: order.Uint16(body[0:2]), tsUnits: 1000000}
+				// look for the if_tsresol option
+				for opts := body[8:]; len(opts) >= 4; {
+					code, optLen := order.Uint16(opts[0:2]), int(order.Uint16(opts[2:4]))
+					padded := (optLen + 3) &^ 3
+					if code == 0 || 4+padded > len(opts) {
+						break
+					}
+					if code == PCAPNG_OPT_IF_TSRESOL && optLen >= 1 {
+						res := opts[4]
+						// 2^64 and 10^20 do not fit in the 64 bit timestamp units
+						if (res&0x80 != 0 && res&0x7F >= 64) || (res&0x80 == 0 && res >= 20) {
+							return packets, fmt.Errorf("invalid if_tsresol %#x at byte %d", res, pos)
+						}
+						iface.tsUnits = 1
+						for i := 0; i < int(res&0x7F); i++ {
+							if res&0x80 != 0 {
+								iface.tsUnits *= 2
+							} else {
+								iface.tsUnits *= 10
+							}
+						}
+					}
+					opts = opts[4+padded:]
+				}
+				interfaces = append(interfaces, iface)
+			}
+		case PCAPNG_BLOCK_EPB:
+			if len(body) >= 20 {
+				ifaceID := int(order.Uint32(body[0:4]))
+				ts := uint64(order.Uint32(body[4:8]))<<32 | uint64(order.Uint32(body[8:12]))
+				capLen := int(order.Uint32(body[12:16]))
+				if ifaceID < len(interfaces) && 20+capLen <= len(body) {
+					iface := interfaces[ifaceID]
+					// 128 bit product: the fraction times 1e9 overflows 64 bits with more than ~1.8e10 units per second
+					hi, lo := bits.Mul64(ts%iface.tsUnits, 1000000000)
+					nanoseconds, _ := bits.Div64(hi, lo, iface.tsUnits)
+					t := time.Unix(int64(ts/iface.tsUnits), int64(nanoseconds))
+					packets = append(packets, capturedPacket{t, iface.linkType, body[20 : 20+capLen]})
+				}
+			}
+		case PCAPNG_BLOCK_SPB:
+			// no timestamp in simple packet blocks
+			if len(interfaces) > 0 && len(body) >= 4 {
+				capLen := int(order.Uint32(body[0:4]))
+				if 4+capLen > len(body) {
+					capLen = len(body) - 4
+				}
+				packets = append(packets, capturedPacket{time.Time{}, interfaces[0].linkType, body[4 : 4+capLen]})
+			}
+		}
+		pos += length
+	}
+	return packets, nil
+}
+
+// extractUDP finds the IPv4/IPv6 packet in a frame and returns the UDP addresses and payload
+func extractUDP(linkType uint16, frame []byte) (*net.UDPAddr, *net.UDPAddr, []byte, bool) {
+	var ipPacket []byte
+	switch linkType {
+	case LINKTYPE_ETHERNET:
+		if len(frame) < 14 {
+			return nil, nil, nil, false
+		}
+		etherType := binary.BigEndian.Uint16(frame[12:14])
+		pos := 14
+		for (etherType == 0x8100 || etherType == 0x88A8) && len(frame) >= pos+4 { // VLAN tags
+			etherType = binary.BigEndian.Uint16(frame[pos+2 : pos+4])
+			pos += 4
+		}
+		if etherType != 0x0800 && etherType != 0x86DD {
+			return nil, nil, nil, false
+		}
+		ipPacket = frame[pos:]
+	case LINKTYPE_RAW, LINKTYPE_IPV4, LINKTYPE_IPV6:
+		ipPacket = frame
+	case LINKTYPE_NULL:
+		if len(frame) < 4 {
+			return nil, nil, nil, false
+		}
+		ipPacket = frame[4:]
+	case LINKTYPE_LINUX_SLL:
+		if len(frame) < 16 {
+			return nil, nil, nil, false
+		}
+		ipPacket = frame[16:]
+	case LINKTYPE_LINUX_SLL2:
+		if len(frame) < 20 {
+			return nil, nil, nil, false
+		}
+		ipPacket = frame[20:]
+	default:
+		return nil, nil, nil, false
+	}
+	if len(ipPacket) < 1 {
+		return nil, nil, nil, false
+	}
+
+	var srcIP, dstIP net.IP
+	var udp []byte
+	switch ipPacket[0] >> 4 {
+	case 4:
+		if len(ipPacket) < 20 {
+			return nil, nil, nil, false
+		}
+		headerLen := int(ipPacket[0]&0x0F) * 4
+		totalLen := int(binary.BigEndian.Uint16(ipPacket[2:4]))
+		fragment := binary.BigEndian.Uint16(ipPacket[6:8])
+		if ipPacket[9] != 17 || fragment&0x3FFF != 0 || headerLen < 20 || len(ipPacket) < headerLen {
+			return nil, nil, nil, false // not UDP, or a fragment
+		}
+		if totalLen > headerLen && totalLen <= len(ipPacket) {
+			ipPacket = ipPacket[:totalLen] // remove the Ethernet padding
+		}
+		srcIP, dstIP = net.IP(ipPacket[12:16]), net.IP(ipPacket[16:20])
+		udp = ipPacket[headerLen:]
+	case 6:
+		if len(ipPacket) < 40 {
+			return nil, nil, nil, false
+		}
+		next := ipPacket[6]
+		srcIP, dstIP = net.IP(ipPacket[8:24]), net.IP(ipPacket[24:40])
+		payloadLen := int(binary.BigEndian.Uint16(ipPacket[4:6]))
+		rest := ipPacket[40:]
+		if payloadLen <= len(rest) {
+			rest = rest[:payloadLen]
+		}
+		// skip the extension headers (hop-by-hop, routing, destination options)
+		for (next == 0 || next == 43 || next == 60) && len(rest) >= 8 {
+			extLen := 8 + int(rest[1])*8
+			if extLen > len(rest) {
+				return nil, nil, nil, false
+			}
+			next, rest = rest[0], rest[extLen:]
+		}
+		if next != 17 {
+			return nil, nil, nil, false
+		}
+		udp = rest
+	default:
+		return nil, nil, nil, false
+	}
+	if len(udp) < 8 {
+		return nil, nil, nil, false
+	}
+	udpLen := int(binary.BigEndian.Uint16(udp[4:6]))
+	payload := udp[8:]
+	if udpLen >= 8 && udpLen-8 <= len(payload) {
+		payload = payload[:udpLen-8]
+	}
+	src := &net.UDPAddr{IP: srcIP, Port: int(binary.BigEndian.Uint16(udp[0:2]))}
+	dst := &net.UDPAddr{IP: dstIP, Port: int(binary.BigEndian.Uint16(udp[2:4]))}
+	return src, dst, payload, true
+}
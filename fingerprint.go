@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Server implementation fingerprinting ("fingerprint" command). A few probes (the NTP versions, a request with an
+// unusual poll, an unknown extension field, interleaved mode, control queries and a short burst for rate limiting)
+// give traits of the server, and every trait adds points to the implementations known to show it. The result is a
+// best guess with the evidence behind it, not a certainty: most traits depend on the version and configuration of
+// the server, and only the version string of mode 6 (when the server answers it) names the implementation.
+
+const (
+	FINGERPRINT_POLL  = 13 // poll of the probe request, no client uses it, so an answer with 13 is an echo
+	FINGERPRINT_BURST = 4  // requests of the rate limiting probe
+)
+
+var fingerprintImplementations = []string{
+	"ntpd", "ntpsec", "chrony", "ntpd-rs", "openntpd", "w32time", "cisco", "juniper", "gps appliance", "sntp server",
+}
+
+// reference IDs of stratum 1 servers with a GNSS receiver
+var gnssRefIDs = map[string]bool{"GPS": true, "GPSs": true, "GNSS": true, "GAL": true, "GLO": true, "GLN": true,
+	"BDS": true, "PPS": true, "IRIG": true}
+
+type fingerprintCandidate struct {
+	score    int
+	evidence []string
+}
+
+type fingerprintScores map[string]*fingerprintCandidate
+
+func (f fingerprintScores) add(points int, evidence string, implementations ...string) {
+	for _, name := range implementations {
+		c := f[name]
+		c.score += points
+		c.evidence = append(c.evidence, evidence)
+	}
+}
+
+// fingerprintPoll sends an NTPv4 request with poll 13 and returns the poll of the response (ok false: no answer)
+func fingerprintPoll(ip string, timeout float64, opts MeasurementOptions) (int8, bool) {
+	template, err := parseCraftTemplate("", fmt.Sprintf(`{"version":4,"poll":%d,"tx_timestamp":"now"}`, FINGERPRINT_POLL), "")
+	if err != nil {
+		return 0, false
+	}
+	result, _, code := performCraftedMeasurement(ip, timeout, "", template, opts)
+	if code != 0 {
+		return 0, false
+	}
+	poll, ok := result["poll"].(int8)
+	return poll, ok
+}
+
+// performFingerprint probes a server and guesses its implementation
+func performFingerprint(host string, timeout float64, opts MeasurementOptions) (map[string]interface{}, string, int) {
+	var output strings.Builder
+	error_message := map[string]interface{}{}
+	scores := fingerprintScores{}
+	for _, name := range fingerprintImplementations {
+		scores[name] = &fingerprintCandidate{}
+	}
+	traits := map[string]interface{}{}
+
+	ipv4, ipv6, err := resolveScanTarget(host)
+	if err != nil {
+		m := fmt.Sprintf("could not resolve %s: %v\n", host, err)
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 1
+	}
+	ip := ""
+	if len(ipv4) > 0 {
+		ip = ipv4[0]
+	} else if len(ipv6) > 0 {
+		ip = ipv6[0]
+	}
+	output.WriteString(fmt.Sprintf("fingerprinting %s (%s)\n", host, ip))
+
+	// versions: which ones answer, and with which version number
+	allVersions, _, _ := check_all_ntp_versions(ip, timeout, "", false, "", SCAN_PAUSE, false, opts)
+	responseVersions := map[string]interface{}{}
+	answered := map[string]bool{}
+	var v4 map[string]interface{}
+	changed := []string{}
+	for _, name := range []string{"ntpv1", "ntpv2", "ntpv3", "ntpv4", "ntpv5"} {
+		info := allVersions[name].(map[string]interface{})
+		negotiation := info["negotiation"].(map[string]interface{})
+		responseVersions[name] = negotiation["reply_version"] // nil without a reply
+		if negotiation["answered"] != true {
+			continue
+		}
+		answered[name] = true
+		if name == "ntpv4" && info["return_code"] == 0 {
+			v4 = info["result"].(map[string]interface{})
+		}
+		if negotiation["status"] != "same" {
+			changed = append(changed, fmt.Sprintf("%s -> NTPv%v", name, negotiation["reply_version"]))
+		}
+	}
+	traits["response_versions"] = responseVersions
+	if v4 == nil {
+		m := fmt.Sprintf("%s did not answer NTPv4, nothing to fingerprint\n", ip)
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 3
+	}
+
+	if len(changed) > 0 {
+		traits["version_changed"] = changed
+		scores.add(2, "answers with another version than the request ("+strings.Join(changed, ", ")+")",
+			"sntp server", "gps appliance", "w32time")
+	} else {
+		scores.add(1, "answers every version with the version of the request",
+			"ntpd", "ntpsec", "chrony", "openntpd", "cisco", "juniper")
+	}
+	if answered["ntpv1"] {
+		scores.add(1, "answers NTPv1 requests (version 0)", "sntp server", "gps appliance")
+	}
+	v5 := responseVersions["ntpv5"] == uint8(NTPV5_VERSION)
+	traits["ntpv5"] = v5
+	if v5 {
+		scores.add(3, "answers NTPv5 (drafts implemented by chrony and ntpd-rs)", "chrony", "ntpd-rs")
+	}
+
+	// reference ID, stratum and precision of the NTPv4 answer
+	stratum, _ := v4["stratum"].(uint8)
+	precision, _ := v4["precision"].(int8)
+	refID, _ := v4["ref_id"].(uint32)
+	refIDText := strings.TrimRight(string([]byte{byte(refID >> 24), byte(refID >> 16), byte(refID >> 8), byte(refID)}), "\x00")
+	traits["stratum"] = stratum
+	traits["precision"] = precision
+	traits["root_disp"] = v4["root_disp"]
+	if stratum == 1 {
+		traits["ref_id"] = refIDText
+		if gnssRefIDs[refIDText] {
+			scores.add(2, fmt.Sprintf("stratum 1 with GNSS reference %q", refIDText), "gps appliance")
+			scores.add(1, fmt.Sprintf("stratum 1 with GNSS reference %q", refIDText), "ntpd", "chrony")
+		} else if refIDText == "LOCL" {
+			scores.add(2, "stratum 1 synchronized to its local clock (\"LOCL\")", "w32time")
+		}
+	} else if stratum > 1 && stratum < 16 {
+		traits["ref_id"] = fmt.Sprintf("%d.%d.%d.%d", byte(refID>>24), byte(refID>>16), byte(refID>>8), byte(refID))
+	}
+	// precision: chrony, ntpd and ntpsec measure the precision of their clock (a few ns to a µs, log2 -30..-18),
+	// w32time and simple servers send a fixed value
+	switch {
+	case precision >= 0:
+		scores.add(1, fmt.Sprintf("precision %d (not set)", precision), "sntp server", "gps appliance")
+	case precision == -6:
+		scores.add(2, "precision -6 (1/64 s, the fixed value of older w32time)", "w32time")
+	case precision == -23:
+		// the fixed value of recent w32time, but also a common measured value
+		scores.add(1, "precision -23 (fixed value of recent w32time, or measured)", "w32time", "ntpd", "ntpsec", "chrony")
+	case precision >= -30 && precision <= -18:
+		scores.add(1, fmt.Sprintf("precision %d (measured clock precision)", precision), "ntpd", "ntpsec", "chrony")
+	}
+
+	// poll echo
+	time.Sleep(SCAN_PAUSE)
+	if poll, ok := fingerprintPoll(ip, timeout, opts); ok {
+		traits["poll_echo"] = poll == FINGERPRINT_POLL
+		traits["response_poll"] = poll
+		if poll == FINGERPRINT_POLL {
+			scores.add(1, "copies the poll of the request", "ntpd", "ntpsec", "chrony", "openntpd", "cisco", "juniper")
+		} else {
+			scores.add(1, fmt.Sprintf("answers with its own poll (%d)", poll), "w32time", "sntp server", "gps appliance")
+		}
+	}
+
+	// unknown extension field
+	time.Sleep(SCAN_PAUSE)
+	extension := scanExtensionEcho(ip, timeout, 4, "", opts)
+	traits["unknown_extension"] = extension
+	if extension["answered"] == true {
+		scores.add(1, "answers a request with an unknown extension field", "chrony", "ntpd-rs")
+	} else {
+		scores.add(1, "drops a request with an unknown extension field (taken as a bad MAC)", "ntpd", "ntpsec")
+	}
+
+	// interleaved mode: chrony is the only common server with interleaved client/server mode
+	time.Sleep(SCAN_PAUSE)
+	if result, _, code := performNTPv4InterleavedMeasurement(ip, timeout, SCAN_SAMPLES, opts); code == 0 {
+		supported := result["interleaved"].(map[string]interface{})["supported"] == true
+		traits["interleaved"] = supported
+		if supported {
+			scores.add(4, "answers in interleaved mode", "chrony")
+		} else if v5 {
+			scores.add(2, "answers NTPv5 but not in interleaved mode", "ntpd-rs")
+		}
+	}
+
+	// control queries: only ntpd (and the implementations based on it) answer them
+	time.Sleep(SCAN_PAUSE)
+	if result, _, code := performMode6Measurement(ip, timeout, opts); code == 0 && result["answers_control_queries"] != true {
+		// error responses only (authentication required, prohibited): mode 6 is implemented, but nothing is disclosed
+		traits["mode6"] = false
+		traits["mode6_rejected"] = result["rejected"]
+		scores.add(2, "rejects mode 6 control queries with error responses", "ntpd", "ntpsec", "cisco", "juniper")
+	} else if code == 0 {
+		traits["mode6"] = true
+		variables, _ := result["system_variables"].(map[string]string)
+		version := strings.ToLower(variables["version"])
+		system := strings.ToLower(variables["system"])
+		traits["mode6_version"] = variables["version"]
+		traits["mode6_system"] = variables["system"]
+		switch {
+		case strings.Contains(version, "ntpsec"):
+			scores.add(8, "mode 6 version string: "+variables["version"], "ntpsec")
+		case strings.Contains(system, "junos"):
+			scores.add(8, "mode 6 system: "+variables["system"], "juniper")
+		case strings.Contains(version, "cisco") || strings.Contains(system, "cisco"):
+			scores.add(8, "mode 6 version string: "+variables["version"], "cisco")
+		case strings.Contains(version, "ntpd"):
+			scores.add(8, "mode 6 version string: "+variables["version"], "ntpd")
+		default:
+			scores.add(3, "answers mode 6 control queries", "ntpd", "ntpsec", "cisco", "juniper")
+		}
+	} else {
+		traits["mode6"] = false
+		scores.add(1, "does not answer mode 6 control queries", "chrony", "ntpd-rs", "openntpd", "w32time")
+	}
+
+	// kiss-o'-death: ntpd sends RATE when "limited kod" is configured
+	time.Sleep(SCAN_PAUSE)
+	kiss := []string{}
+	for i := 0; i < FINGERPRINT_BURST; i++ {
+		if i > 0 {
+			time.Sleep(SCAN_BURST_INTERVAL)
+		}
+		if result, _, code := performNTPv4Measurement(ip, timeout, opts); code == 0 {
+			if k := kissCode(result); k != "" {
+				kiss = append(kiss, k)
+			}
+		}
+	}
+	traits["kiss_codes"] = kiss
+	if len(kiss) > 0 {
+		scores.add(2, "sends kiss-o'-death "+strings.Join(kiss, ", ")+" to a burst of requests", "ntpd", "ntpsec")
+	}
+
+	// ranking
+	candidates := []map[string]interface{}{}
+	total := 0
+	for _, name := range fingerprintImplementations {
+		if c := scores[name]; c.score > 0 {
+			total += c.score
+			candidates = append(candidates, map[string]interface{}{
+				"implementation": name,
+				"score":          c.score,
+				"evidence":       c.evidence,
+			})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i]["score"].(int) > candidates[j]["score"].(int)
+	})
+	bestGuess, confidence, share := "unknown", "low", 0.0
+	if len(candidates) > 0 {
+		best := candidates[0]["score"].(int)
+		share = float64(best) / float64(total)
+		tie := len(candidates) > 1 && candidates[1]["score"].(int) == best
+		if !tie {
+			bestGuess = candidates[0]["implementation"].(string)
+		}
+		if !tie && best >= 8 && share >= 0.5 {
+			confidence = "high"
+		} else if !tie && best >= 4 && share >= 0.3 {
+			confidence = "medium"
+		}
+	}
+	output.WriteString(fmt.Sprintf("best guess: %s (confidence %s)\n", bestGuess, confidence))
+	return map[string]interface{}{
+		"Host":               host,
+		"Measured server IP": ip,
+		"best_guess":         bestGuess,
+		"confidence":         confidence,
+		"score_share":        share,
+		"candidates":         candidates,
+		"traits":             traits,
+	}, output.String(), 0
+}
@@ -0,0 +1,98 @@
+//go:build linux
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// Status bits and clock states of adjtimex (from linux/timex.h, they are not in x/sys/unix)
+const (
+	STA_PLL       = 0x0001
+	STA_PPSFREQ   = 0x0002
+	STA_PPSTIME   = 0x0004
+	STA_FLL       = 0x0008
+	STA_INS       = 0x0010
+	STA_DEL       = 0x0020
+	STA_UNSYNC    = 0x0040
+	STA_FREQHOLD  = 0x0080
+	STA_PPSSIGNAL = 0x0100
+	STA_PPSJITTER = 0x0200
+	STA_PPSWANDER = 0x0400
+	STA_PPSERROR  = 0x0800
+	STA_CLOCKERR  = 0x1000
+	STA_NANO      = 0x2000
+	STA_MODE      = 0x4000
+	STA_CLK       = 0x8000
+
+	TIME_OK    = 0
+	TIME_INS   = 1
+	TIME_DEL   = 2
+	TIME_OOP   = 3
+	TIME_WAIT  = 4
+	TIME_ERROR = 5
+)
+
+var adjtimexStatusNames = []struct {
+	bit  int64
+	name string
+}{
+	{STA_PLL, "PLL"}, {STA_PPSFREQ, "PPSFREQ"}, {STA_PPSTIME, "PPSTIME"}, {STA_FLL, "FLL"},
+	{STA_INS, "INS"}, {STA_DEL, "DEL"}, {STA_UNSYNC, "UNSYNC"}, {STA_FREQHOLD, "FREQHOLD"},
+	{STA_PPSSIGNAL, "PPSSIGNAL"}, {STA_PPSJITTER, "PPSJITTER"}, {STA_PPSWANDER, "PPSWANDER"},
+	{STA_PPSERROR, "PPSERROR"}, {STA_CLOCKERR, "CLOCKERR"}, {STA_NANO, "NANO"}, {STA_MODE, "MODE"}, {STA_CLK, "CLK"},
+}
+
+var adjtimexStateNames = map[int]string{
+	TIME_OK:    "TIME_OK",
+	TIME_INS:   "TIME_INS",
+	TIME_DEL:   "TIME_DEL",
+	TIME_OOP:   "TIME_OOP",
+	TIME_WAIT:  "TIME_WAIT",
+	TIME_ERROR: "TIME_ERROR",
+}
+
+// readLocalClockState reads (without changing anything, modes = 0) the kernel clock discipline state with adjtimex.
+// The errors are in microseconds, the frequency in ppm with 16 fractional bits, the offset in micro or nanoseconds
+// (STA_NANO).
+func readLocalClockState() (map[string]interface{}, error) {
+	var tx unix.Timex
+	state, err := unix.Adjtimex(&tx)
+	if err != nil {
+		return nil, err
+	}
+	status := int64(tx.Status)
+	flags := []string{}
+	for _, s := range adjtimexStatusNames {
+		if status&s.bit != 0 {
+			flags = append(flags, s.name)
+		}
+	}
+	stateName, ok := adjtimexStateNames[state]
+	if !ok {
+		stateName = "unknown"
+	}
+	offset := float64(tx.Offset) / 1e6
+	if status&STA_NANO != 0 {
+		offset = float64(tx.Offset) / 1e9
+	}
+	leap := "none"
+	if status&STA_INS != 0 {
+		leap = "insert"
+	} else if status&STA_DEL != 0 {
+		leap = "delete"
+	}
+	return map[string]interface{}{
+		"source":          "adjtimex",
+		"synchronized":    status&STA_UNSYNC == 0 && state != TIME_ERROR,
+		"clock_state":     stateName,
+		"status_raw":      status,
+		"status_flags":    flags,
+		"estimated_error": float64(tx.Esterror) / 1e6,
+		"maximum_error":   float64(tx.Maxerror) / 1e6,
+		"frequency_ppm":   float64(tx.Freq) / 65536,
+		"offset":          offset,
+		"tai_offset":      int64(tx.Tai),
+		"leap_pending":    leap,
+	}, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// readLocalClockState is only implemented on Linux (adjtimex)
+func readLocalClockState() (map[string]interface{}, error) {
+	return nil, errors.New("reading the local clock state is only supported on Linux")
+}
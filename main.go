@@ -1,10 +1,13 @@
 package main
 
 import (
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,19 +28,78 @@ nts <host>
 	<NTP_version> <host_ip> <timeout_s>
 */
 var usage_info = `Usage:
-    <mode> <host> [-draft <string>] [-t <timeout>] [-d] [-ipv <4|6>]
+    <mode> <host> [-draft <string>] [-t <timeout>] [-d] [-ipv <4|6>] [-stagger <s>]
 
 draft modes (available):
     draft_ntpv5 <host> <draft>
     draft_ntpv5 <host_ip> <draft> <timeout_s>
+    ntpv5_refids <host> [-serverid <hex>[,<hex>...]] [-ownid <hex>] [-chunk <bytes>]
+    ntpv5_interleaved <host> [-samples <n>]
+
+interleaved mode (NTPv4, like chrony "xleave"):
+    ntpv4_interleaved <host> [-samples <n>]
+
+packet crafting (any header or extension field):
+    craft <host> [-profile <name>] [-template <file|json>] [-set <field>=<value>[,<field>=<value>...]] [-draft <string>]
+    client_profiles <host>
+    mode6 <host>
+    mode7_audit <host>
+    scan <host> [-mode7]
+    fingerprint <host>
+
+offline decoding (no measurement):
+    decode <hex|file|capture.pcap|capture.pcapng> [-draft <string>]
+    passive <capture.pcap|capture.pcapng> [-draft <string>]
 
 where:
-	- <mode> can be "nts" (with ntpv4), "draft_ntpv5", "allntpv" (to measure all possible NTP versions) or an NTP version: ntpv1,ntpv2,ntpv3,ntpv4,ntpv5
+	- <mode> can be "nts" (with ntpv4), "draft_ntpv5", "allntpv" (to measure all possible NTP versions and NTS, in parallel) or an NTP version: ntpv1,ntpv2,ntpv3,ntpv4,ntpv5
+	- "ntpv5_refids" retrieves the reference IDs Bloom filter of an NTPv5 server (in several requests)
+	- "ntpv5_interleaved" and "ntpv4_interleaved" measure in interleaved mode and compare basic and interleaved offsets
+	- "decode" parses NTP packets given as a hex string, a file with one raw packet or a pcap/pcapng capture (UDP port
+	  123), with the same parsers (and JSON) as the measurements. "-draft" selects the NTPv5 header layout
+	- "passive" pairs the requests and responses of a capture and computes offset and rtt of every exchange with the
+	  capture times, with statistics per server
+	- "craft" sends a request where any field can be set and decodes the response. The fields (template keys) are:
+	  version, leap, mode, stratum, poll, precision, root_delay, root_disp (seconds), ref_id (hex, IPv4 or ASCII),
+	  ref_timestamp, orig_timestamp, recv_timestamp, tx_timestamp (number, "0x..." hex, "now" or RFC 3339 time),
+	  timescale, era, flags, server_cookie, client_cookie (NTPv5) and extensions ([{"type":..,"data":"<hex>"}])
+	- "client_profiles" sends the request of every client profile and shows how the server answered each of them.
+	  Profiles: chrony, ntpd, ntpv5-padded, sntp, systemd-timesyncd, windows
+	- "mode6" sends NTP control queries (like ntpq: system variables, associations and their variables, clock variables)
+	  and reports if the server answers them without authentication and what it discloses
+	- "mode7_audit" (only for servers we are allowed to audit) sends ONE mode 7 MON_GETLIST request (monlist) to one
+	  server and reports if it replies, the response size and the amplification factor
+	- "scan" (only for servers we are allowed to audit) builds a capability profile of a server: NTP versions, NTPv5
+	  drafts, NTS and its AEAD algorithms, interleaved mode, extension fields, symmetric keys, mode 6, rate limiting
+	  and IPv4/IPv6. The mode 7 monlist request is sent only with "-mode7"
+	- "fingerprint" guesses the implementation of a server (ntpd, ntpsec, chrony, ntpd-rs, OpenNTPD, w32time,
+	  Cisco, Juniper, GPS appliance, simple SNTP server) from the traits of its answers, with confidence and evidence
+	- [-profile <name>] (craft) start from the request of a client profile, the template and -set change it further
 	- <host> can be a domain name or an IP address
-	- timeout is a float64 in seconds
+	- timeout is a float64 in seconds. NTP requests always wait until the timeout, to count every datagram of the answer
 	- [-draft <string>] the string can be "draft-ietf-ntp-ntpv5-05" or "draft-ietf-ntp-ntpv5-06" 
 	- [-d] means debug mode. More data will be shown on screen.
-	- [-ipv <4|6>] can be -ipv 4 or -ipv 6. Only for NTS!! (at the moment). It will try that ip type version. If it fails, it tries the other one
+	- [-ipv <4|6>] can be -ipv 4 or -ipv 6. Only for NTS and allntpv. It will try that ip type version. If it fails, it tries the other one
+	- [-serverid <hex>[,<hex>...]] (ntpv5_refids) 120-bit server IDs (30 hex chars) to look for in the filter
+	- [-ownid <hex>] (ntpv5_refids) our own server ID. If it is in the filter, there is a synchronization loop
+	- [-chunk <bytes>] (ntpv5_refids) how many bytes of the filter to ask in one request (multiple of 4, default 256)
+	- [-samples <n>] (interleaved modes) how many consecutive requests to send (at least 2, default 4)
+	- [-mode7] (scan) also send the mode 7 MON_GETLIST request of "mode7_audit" (only to servers you are allowed to audit)
+	- [-stagger <s>] (allntpv) seconds between the start of two measurements (default 0.2, 0 sends all at once)
+	- [-timescale <utc|tai|ut1|smeared>] (ntpv5, draft_ntpv5) the timescale to ask the NTPv5 server for (default utc)
+	- [-simulate-time <RFC 3339 time>] (NTP modes, for testing) our clock and the server timestamps are moved to that time,
+	  for example "2036-02-07T06:28:20Z" to test the parsers after the 2036 era rollover
+	- [-hwts] (NTP modes, Linux) also ask the kernel for hardware timestamps (the NIC must already be configured for them)
+	- [-unconnected] (NTP modes) use an unconnected socket: responses from any address are accepted, and every datagram
+	  received until the timeout is recorded in the result
+	- [-keys <ntp.keys> -key <id>] (ntpv3, ntpv4 and the modes using them) authenticate the requests with a symmetric key
+	  (MD5, SHA1 or AES128CMAC) and verify the MAC of the response ("authentication" in the result)
+	- [-privacy] (NTP modes) client data minimization: random transmit timestamp (the response must echo it), random
+	  source port for every request and all the other client fields 0 (the local send time is kept only internally)
+	- [-pcap <file>] write every packet sent and received to a pcapng file (with synthesized Ethernet/IP/UDP headers),
+	  each packet has a comment with the "measurement_id" of the result
+	- [-pcap-ke] (nts, with -pcap) also write the NTS-KE connection (encrypted) and, as a comment, the decoded NTS-KE
+	  records (next protocol, AEAD, server, port, cookie count and lengths). The TLS secrets are not written
 
 Obs:
 	- we support both IPv4 and IPv6
@@ -83,6 +145,12 @@ Warning:
     host vs measured server ip
 */
 func main() {
+	os.Exit(run())
+}
+
+// run is the tool (main without the exit), so that the deferred cleanups (like closing the pcap file) happen before
+// the process exits. It returns the exit code
+func run() int {
 	args := os.Args[1:]
 	//server := "139.84.137.244" //"ntpd-rs.sidnlabs.nl" //args := os.Args[1:]
 	//server := "ntpd-rs.sidnlabs.nl"
@@ -94,7 +162,7 @@ func main() {
 
 	if len(args) < 2 {
 		fmt.Println(usage_info)
-		os.Exit(-100)
+		return -100
 	}
 	//parsing command line
 	mode := args[0]
@@ -105,6 +173,24 @@ func main() {
 	timeout := flagSet.Float64("t", 7.0, "timeout in seconds")
 	debugArg := flagSet.Bool("d", false, "enable debug output")
 	ipv := flagSet.String("ipv", "", "force IP version (4 or 6)")
+	stagger := flagSet.Float64("stagger", 0.2, "allntpv: seconds between the start of two measurements")
+	serverIDs := flagSet.String("serverid", "", "NTPv5 server IDs to look for in the reference IDs filter (comma separated hex)")
+	ownID := flagSet.String("ownid", "", "our own NTPv5 server ID (hex), used to detect synchronization loops")
+	chunk := flagSet.Int("chunk", 256, "bytes of the NTPv5 reference IDs filter to ask for in one request")
+	samples := flagSet.Int("samples", 4, "number of consecutive requests in interleaved modes")
+	keysPath := flagSet.String("keys", "", "ntp.keys file with the symmetric key of -key")
+	keyID := flagSet.Uint("key", 0, "authenticate NTPv3/NTPv4 requests with this key ID of the -keys file")
+	privacy := flagSet.Bool("privacy", false, "random transmit timestamp and source port, other client fields 0")
+	unconnected := flagSet.Bool("unconnected", false, "use an unconnected socket: accept responses from any address and listen until the timeout")
+	hwts := flagSet.Bool("hwts", false, "also ask for hardware timestamps (Linux, the NIC must be configured for them)")
+	timescaleArg := flagSet.String("timescale", "utc", "NTPv5 timescale to ask for (utc, tai, ut1, smeared)")
+	profile := flagSet.String("profile", "", "craft: start from the request of a client profile ("+strings.Join(clientProfileNames(), ", ")+")")
+	templateArg := flagSet.String("template", "", "craft: JSON template of the request (file name or inline JSON)")
+	setArg := flagSet.String("set", "", "craft: fields to set, as field=value,field=value")
+	withMode7 := flagSet.Bool("mode7", false, "scan: also send the mode 7 monlist request (only to servers you are allowed to audit)")
+	pcapPath := flagSet.String("pcap", "", "write the packets sent and received to this pcapng file")
+	pcapKE := flagSet.Bool("pcap-ke", false, "with -pcap, also write the NTS-KE connection and its decoded records (not the TLS secrets)")
+	simulateTime := flagSet.String("simulate-time", "", "pretend our clock and the server timestamps are at this time (RFC 3339), to test other NTP eras")
 
 	// Parse only args after <mode> and <host>
 	flagSet.Parse(args[2:])
@@ -112,59 +198,166 @@ func main() {
 	// Validate ipv
 	if *ipv != "" && *ipv != "4" && *ipv != "6" {
 		fmt.Println("Error: -ipv must be 4 or 6")
-		os.Exit(-100)
+		return -100
+	}
+	if *stagger < 0 {
+		fmt.Println("Error: stagger must be >=0")
+		return -100
 	}
 	// Validate timeout
 	if *timeout <= 0 {
 		fmt.Println("Error: timeout must be >0 ")
-		os.Exit(-100)
+		return -100
+	}
+	// Validate server IDs and chunk size (only used by ntpv5_refids)
+	serverIDList := []string{}
+	if *serverIDs != "" {
+		serverIDList = strings.Split(*serverIDs, ",")
+	}
+	for _, id := range append(serverIDList, *ownID) {
+		if id == "" {
+			continue
+		}
+		if _, err := parseServerID(id); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return -100
+		}
+	}
+	if *chunk < 4 || *chunk > NTPV5_REFID_FILTER_BYTES || *chunk%4 != 0 {
+		fmt.Printf("Error: chunk must be a multiple of 4 between 4 and %d\n", NTPV5_REFID_FILTER_BYTES)
+		return -100
+	}
+	timescale, tsErr := parseNTPv5Timescale(*timescaleArg)
+	if tsErr != nil {
+		fmt.Printf("Error: %v\n", tsErr)
+		return -100
+	}
+	if *simulateTime != "" {
+		simTime, err := time.Parse(time.RFC3339Nano, *simulateTime)
+		if err != nil {
+			fmt.Printf("Error: -simulate-time must be an RFC 3339 time (like 2036-02-07T06:28:16Z): %v\n", err)
+			return -100
+		}
+		simulatedClockShift = time.Until(simTime)
+	}
+	if *samples < 2 {
+		fmt.Println("Error: samples must be at least 2")
+		return -100
 	}
 	warning_m := ""
 	// Validate supported draft
 	if *draft != "" && (*draft != "draft-ietf-ntp-ntpv5-05" && *draft != "draft-ietf-ntp-ntpv5-06") {
-		warning_m = fmt.Sprintln("WARNING: draft can be either draft-ietf-ntp-ntpv5-05 or draft-ietf-ntp-ntpv5-06. The code will use draft 05 header for parsing\n")
+		warning_m = "WARNING: draft can be either draft-ietf-ntp-ntpv5-05 or draft-ietf-ntp-ntpv5-06. The code will use draft 05 header for parsing\n\n"
 		//os.Exit(-100)
 	}
-	if mode == "nts" {
-		measureNTS(host, *ipv, *timeout)
-		os.Exit(0)
+	if *pcapPath != "" {
+		p, err := openPcap(*pcapPath, *pcapKE)
+		if err != nil {
+			fmt.Printf("Error: could not create the pcap file: %v\n", err)
+			return -100
+		}
+		pcapCapture = p
+		defer p.close()
+	}
+	var key *ntpKey
+	if *keyID != 0 || *keysPath != "" {
+		if *keyID == 0 || *keysPath == "" {
+			fmt.Println("Error: -keys and -key must be used together")
+			return -100
+		}
+		k, err := loadKey(*keysPath, uint32(*keyID))
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return -100
+		}
+		key = k
 	}
 	//ntp versions part
+	opts := MeasurementOptions{HardwareTimestamps: *hwts, Unconnected: *unconnected, Privacy: *privacy, Key: key}
 	var output strings.Builder
 	result, debug, err := map[string]interface{}{}, "", 0
-	if mode == "ntpv1" {
-		result, debug, err = performNTPv1Measurement(host, *timeout) //very unlikely to receive an answer as nobody supports ntpv1 anymore
+	if mode == "nts" {
+		result, debug, err = performNTSMeasurement(host, *ipv, *timeout)
+	} else if mode == "ntpv1" {
+		result, debug, err = performNTPv1Measurement(host, *timeout, opts) //very unlikely to receive an answer as nobody supports ntpv1 anymore
 	} else if mode == "ntpv2" {
-		result, debug, err = performNTPv3Measurement(host, *timeout, 2) //same code as in 3 basically
+		result, debug, err = performNTPv3Measurement(host, *timeout, 2, opts) //same code as in 3 basically
 	} else if mode == "ntpv3" {
-		result, debug, err = performNTPv3Measurement(host, *timeout, 3)
+		result, debug, err = performNTPv3Measurement(host, *timeout, 3, opts)
 	} else if mode == "ntpv4" {
-		result, debug, err = performNTPv4Measurement(host, *timeout)
+		result, debug, err = performNTPv4Measurement(host, *timeout, opts)
+	} else if mode == "ntpv4_interleaved" {
+		result, debug, err = performNTPv4InterleavedMeasurement(host, *timeout, *samples, opts)
 	} else if mode == "ntpv5" {
-		result, debug, err = performNTPv5Measurement(host, *timeout, *draft) // or ""
+		result, debug, err = performNTPv5Measurement(host, *timeout, *draft, timescale, opts) // or ""
 		if warning_m != "" {
 			result["warning"] = warning_m
 		}
 	} else if mode == "draft_ntpv5" {
-		result, debug, err = performNTPv5Measurement(host, *timeout, *draft)
+		result, debug, err = performNTPv5Measurement(host, *timeout, *draft, timescale, opts)
 		if warning_m != "" {
 			result["warning"] = warning_m
 		}
+	} else if mode == "ntpv5_refids" {
+		result, debug, err = performNTPv5RefIDsMeasurement(host, *timeout, *draft, *chunk, serverIDList, *ownID, opts)
+		if warning_m != "" {
+			if w, ok := result["warning"]; ok {
+				warning_m += fmt.Sprint(w)
+			}
+			result["warning"] = warning_m
+		}
+	} else if mode == "ntpv5_interleaved" {
+		result, debug, err = performNTPv5InterleavedMeasurement(host, *timeout, *draft, *samples, opts)
+		if warning_m != "" {
+			result["warning"] = warning_m
+		}
+	} else if mode == "craft" {
+		template, tErr := parseCraftTemplate(*profile, *templateArg, *setArg)
+		if tErr != nil {
+			fmt.Printf("Error: %v\n", tErr)
+			return -100
+		}
+		result, debug, err = performCraftedMeasurement(host, *timeout, *draft, template, opts)
+	} else if mode == "client_profiles" {
+		result, debug, err = performClientProfilesMeasurement(host, *timeout, *draft, opts)
+	} else if mode == "mode6" {
+		result, debug, err = performMode6Measurement(host, *timeout, opts)
+	} else if mode == "mode7_audit" {
+		result, debug, err = performMode7Audit(host, *timeout, opts)
+	} else if mode == "scan" {
+		result, debug, err = performScan(host, *timeout, *withMode7, opts)
+	} else if mode == "fingerprint" {
+		result, debug, err = performFingerprint(host, *timeout, opts)
+	} else if mode == "decode" {
+		result, debug, err = decodeInput(host, *draft)
+	} else if mode == "passive" {
+		result, debug, err = performPassiveMeasurement(host, *draft)
 	} else if mode == "allntpv" {
-		result, debug, err = check_all_ntp_versions(host, *timeout, *draft, *debugArg)
+		result, debug, err = check_all_ntp_versions(host, *timeout, *draft, *debugArg, *ipv,
+			time.Duration(*stagger*float64(time.Second)), true, opts)
 		if warning_m != "" {
 			result["warning"] = warning_m
 		}
 	} else {
-		fmt.Println("unknown command\n")
+		fmt.Print("unknown command\n\n")
 		fmt.Println(usage_info)
-		os.Exit(-100)
+		return -100
 	}
 
+	// NTS code 6: the measurement succeeded, but not on the wanted IP family (the result has a warning)
+	succeeded := err == 0 || (mode == "nts" && ntsSucceeded(err))
+	if succeeded && mode != "decode" && mode != "passive" {
+		result["local_clock"] = localClockInfo()
+		result["measurement_id"] = measurementID
+	}
+	if simulatedClockShift != 0 && succeeded {
+		result["simulated_time"] = *simulateTime
+		result["simulated_era"] = ntpEraName(ntpEraOf(localNow()))
+	}
 	if *debugArg {
 		fmt.Println(debug + "\nFinal result:\n")
 	}
-	if err != 0 { //measurement failed. Show the error message
+	if !succeeded { //measurement failed. Show the error message
 		fmt.Println(result["error"])
 	} else {
 		//output is supposed to be empty until here
@@ -172,91 +365,282 @@ func main() {
 		output.WriteString("\n")
 		fmt.Print(output.String())
 	}
-	os.Exit(err)
+	return err
+}
+
+// allVersionsTarget picks the address the UDP measurements of allntpv go to. Without -ipv the host is used as given
+// (every measurement resolves it). With -ipv, a host name is resolved and its first address of that family is used; if
+// it has none, the first address of the other family is used and a warning is returned (like NTS does)
+func allVersionsTarget(host string, ipv string) (string, string, error) {
+	if ipv == "" || net.ParseIP(host) != nil {
+		return host, "", nil
+	}
+	ipv4, ipv6, err := resolveScanTarget(host)
+	if err != nil {
+		return "", "", err
+	}
+	wanted, other := ipv4, ipv6
+	if ipv == "6" {
+		wanted, other = ipv6, ipv4
+	}
+	if len(wanted) > 0 {
+		return wanted[0], "", nil
+	}
+	if len(other) > 0 {
+		return other[0], fmt.Sprintf("%s has no IPv%s address, measured %s instead", host, ipv, other[0]), nil
+	}
+	return "", "", fmt.Errorf("no address found")
 }
-func check_all_ntp_versions(host string, timeout float64, draft_ntpv5 string, show_debug bool) (map[string]interface{}, string, int) {
+
+// versionMeasurement is one of the measurements of allntpv
+type versionMeasurement struct {
+	name    string // key in the result
+	label   string // for the debug output
+	measure func() (map[string]interface{}, string, int)
+}
+
+// check_all_ntp_versions measures every NTP version (and NTS if with_nts) in parallel, each one on its own socket.
+// Measurement i starts after i*stagger, to not send all the requests to the server at the same time
+func check_all_ntp_versions(host string, timeout float64, draft_ntpv5 string, show_debug bool, ipv string,
+	stagger time.Duration, with_nts bool, opts MeasurementOptions) (map[string]interface{}, string, int) {
 	var output strings.Builder
 	finalResult := map[string]interface{}{}
-	result, debug, err := map[string]interface{}{}, "", 0
-	//ntpv1
-	if show_debug {
-		fmt.Printf("Trying NTPv1...\n")
-	}
-	result, debug, err = performNTPv1Measurement(host, timeout)
-	output.WriteString(debug)
-	info1 := map[string]interface{}{}
-	info1["type"] = "ntpv1"
-	info1["result"] = result
-	info1["return_code"] = err
-	finalResult["ntpv1"] = info1
-	if show_debug {
-		fmt.Printf("NTPv1 finished with return code: %v\n", err)
-		fmt.Println(debug)
-	}
-	//ntpv2
-	time.Sleep(1000 * time.Millisecond) // wait a bit to not spam the server
-	if show_debug {
-		fmt.Printf("Trying NTPv2...\n")
-	}
-	result, debug, err = performNTPv3Measurement(host, timeout, 2)
-	output.WriteString(debug)
-	info2 := map[string]interface{}{}
-	info2["type"] = "ntpv2"
-	info2["result"] = result
-	info2["return_code"] = err
-	finalResult["ntpv2"] = info2
-	if show_debug {
-		fmt.Printf("NTPv2 finished with return code: %v\n", err)
-		fmt.Println(debug)
-	}
-	//ntpv3
-	time.Sleep(1000 * time.Millisecond)
-	if show_debug {
-		fmt.Printf("Trying NTPv3...\n")
-	}
-	result, debug, err = performNTPv3Measurement(host, timeout, 3)
-	output.WriteString(debug)
-	info3 := map[string]interface{}{}
-	info3["type"] = "ntpv3"
-	info3["result"] = result
-	info3["return_code"] = err
-	finalResult["ntpv3"] = info3
-	if show_debug {
-		fmt.Printf("NTPv3 finished with return code: %v\n", err)
-		fmt.Println(debug)
-	}
-	//ntpv4
-	time.Sleep(1000 * time.Millisecond)
-	if show_debug {
-		fmt.Printf("Trying NTPv4...\n")
-	}
-	result, debug, err = performNTPv4Measurement(host, timeout)
-	output.WriteString(debug)
-	info4 := map[string]interface{}{}
-	info4["type"] = "ntpv4"
-	info4["result"] = result
-	info4["return_code"] = err
-	finalResult["ntpv4"] = info4
-	if show_debug {
-		fmt.Printf("NTPv4 finished with return code: %v\n", err)
-		fmt.Println(debug)
-	}
-	//ntpv5
-	time.Sleep(1000 * time.Millisecond)
-	if show_debug {
-		fmt.Printf("Trying NTPv5 with draft: %v ...\n", draft_ntpv5)
-	}
-	result, debug, err = performNTPv5Measurement(host, timeout, draft_ntpv5)
-	output.WriteString(debug)
-	info5 := map[string]interface{}{}
-	info5["type"] = "ntpv5"
-	info5["result"] = result
-	info5["return_code"] = err
-	finalResult["ntpv5"] = info5
-	if show_debug {
-		fmt.Printf("NTPv5 finished with return code: %v\n", err)
-		fmt.Println(debug)
+
+	target, familyWarning, resolveErr := allVersionsTarget(host, ipv)
+	if resolveErr != nil {
+		m := fmt.Sprintf("could not resolve %s: %v\n", host, resolveErr)
+		output.WriteString(m)
+		error_message := map[string]interface{}{}
+		error_message["error"] = m
+		return error_message, output.String(), 1
+	}
+	if familyWarning != "" {
+		finalResult["ip_family_warning"] = familyWarning
 	}
 
+	measurements := []versionMeasurement{
+		{"ntpv1", "NTPv1", func() (map[string]interface{}, string, int) {
+			return performNTPv1Measurement(target, timeout, opts)
+		}},
+		{"ntpv2", "NTPv2", func() (map[string]interface{}, string, int) {
+			return performNTPv3Measurement(target, timeout, 2, opts)
+		}},
+		{"ntpv3", "NTPv3", func() (map[string]interface{}, string, int) {
+			return performNTPv3Measurement(target, timeout, 3, opts)
+		}},
+		{"ntpv4", "NTPv4", func() (map[string]interface{}, string, int) {
+			return performNTPv4Measurement(target, timeout, opts)
+		}},
+		{"ntpv5", fmt.Sprintf("NTPv5 with draft: %v", draft_ntpv5), func() (map[string]interface{}, string, int) {
+			return performNTPv5Measurement(target, timeout, draft_ntpv5, TIMESCALE_UTC, opts)
+		}},
+	}
+	if with_nts {
+		// NTS uses the host name given (the certificate is checked against it) and handles -ipv itself
+		measurements = append(measurements, versionMeasurement{"nts", "NTS", func() (map[string]interface{}, string, int) {
+			return ntsVersionResult(host, ipv, timeout)
+		}})
+	}
+
+	infos := make([]map[string]interface{}, len(measurements))
+	debugs := make([]string, len(measurements))
+	var wg sync.WaitGroup
+	for i, m := range measurements {
+		wg.Add(1)
+		go func(i int, name string, label string, measure func() (map[string]interface{}, string, int)) {
+			defer wg.Done()
+			time.Sleep(time.Duration(i) * stagger)
+			if show_debug {
+				fmt.Printf("Trying %s...\n", label)
+			}
+			result, debug, err := measure()
+			infos[i] = map[string]interface{}{
+				"type":        name,
+				"result":      result,
+				"return_code": err,
+			}
+			debugs[i] = debug
+		}(i, m.name, m.label, m.measure)
+	}
+	wg.Wait()
+
+	versions := []string{}
+	for i, m := range measurements {
+		output.WriteString(debugs[i])
+		finalResult[m.name] = infos[i]
+		versions = append(versions, m.name)
+		if show_debug {
+			fmt.Printf("%s finished with return code: %v\n", m.label, infos[i]["return_code"])
+			fmt.Println(debugs[i])
+		}
+	}
+	finalResult["amplification"] = amplificationSummary(finalResult, versions)
+	finalResult["version_matrix"] = versionMatrix(finalResult, []string{"ntpv1", "ntpv2", "ntpv3", "ntpv4", "ntpv5"})
+
 	return finalResult, "", 0
 }
+
+// ntsVersionResult runs the NTS measurement for allntpv and puts its result in the same form as the other versions.
+// "nts_ke" tells how far the key exchange went (see the return codes of NTS.go)
+func ntsVersionResult(host string, ipv string, timeout float64) (map[string]interface{}, string, int) {
+	result, debug, code := performNTSMeasurement(host, ipv, timeout)
+	switch code {
+	case 1:
+		result["nts_ke"] = "failed"
+	case 2:
+		result["nts_ke"] = "no_ntp_address"
+	default:
+		result["nts_ke"] = "ok"
+	}
+	return result, debug, code
+}
+
+// responseLayout is the packet format used to parse a response of this version (see parseAccordingToRightVersion).
+// VN 0, 6 and 7 cannot be parsed
+func responseLayout(version uint8) string {
+	switch version {
+	case 1:
+		return "ntpv1"
+	case 2, 3:
+		return "ntpv3"
+	case 4:
+		return "ntpv4"
+	case 5:
+		return "ntpv5"
+	}
+	return "unknown"
+}
+
+// requestLayout is the packet format of one of our requests with this version field. The NTPv1 request (NTPv1.go)
+// is sent with VN 0
+func requestLayout(version uint8) string {
+	if version == 0 {
+		return "ntpv1"
+	}
+	return responseLayout(version)
+}
+
+// rawVersion reads the version field of a packet kept as hex in a result ("request_raw" or "response_raw")
+func rawVersion(result map[string]interface{}, key string) (uint8, bool) {
+	raw, _ := result[key].(string)
+	packet, err := hex.DecodeString(raw)
+	if err != nil || len(packet) == 0 {
+		return 0, false
+	}
+	return getNtpVersionInResponse(packet), true
+}
+
+// versionNegotiation describes how the server answered one of our requests: the version number sent and the one of
+// the reply, if the reply has the layout of the request, and if the server downgraded or upgraded the version. Both
+// are read from the raw packets (on the wire), because parseAccordingToRightVersion accepts any version silently and
+// a reply with VN 0, 6 or 7 cannot be parsed at all (the measurement fails, but the server answered).
+func versionNegotiation(result map[string]interface{}) map[string]interface{} {
+	negotiation := map[string]interface{}{
+		"answered": false,
+	}
+	requested, ok := rawVersion(result, "request_raw")
+	if ok {
+		negotiation["requested_version"] = requested
+	}
+	replied, answered := rawVersion(result, "response_raw")
+	if !ok || !answered {
+		negotiation["status"] = "no_reply"
+		return negotiation
+	}
+	negotiation["answered"] = true
+	negotiation["reply_version"] = replied
+	negotiation["layout_matched"] = responseLayout(replied) == requestLayout(requested)
+	// our NTPv1 request has VN 0 (see requestLayout), the server answering VN 1 keeps the version
+	compared := requested
+	if compared == 0 {
+		compared = 1
+	}
+	switch {
+	case replied < compared:
+		negotiation["status"] = "downgraded"
+	case replied > compared:
+		negotiation["status"] = "upgraded"
+	default:
+		negotiation["status"] = "same"
+	}
+	return negotiation
+}
+
+// versionMatrix adds the version negotiation to the result of every version and summarizes it: for each requested
+// version, "v<requested> -> v<reply> <status>" (or "no reply"), and which versions were downgraded or upgraded
+func versionMatrix(results map[string]interface{}, versions []string) map[string]interface{} {
+	matrix := map[string]interface{}{}
+	downgraded, upgraded, mismatched := []string{}, []string{}, []string{}
+	for _, version := range versions {
+		info, ok := results[version].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		result, _ := info["result"].(map[string]interface{})
+		negotiation := versionNegotiation(result)
+		info["negotiation"] = negotiation
+		if negotiation["answered"] != true {
+			matrix[version] = "no reply"
+			continue
+		}
+		matrix[version] = fmt.Sprintf("v%d -> v%d %s", negotiation["requested_version"], negotiation["reply_version"],
+			negotiation["status"])
+		if negotiation["status"] == "downgraded" {
+			downgraded = append(downgraded, version)
+		} else if negotiation["status"] == "upgraded" {
+			upgraded = append(upgraded, version)
+		}
+		if negotiation["layout_matched"] != true {
+			mismatched = append(mismatched, version)
+		}
+	}
+	return map[string]interface{}{
+		"matrix":          matrix,
+		"downgraded":      downgraded,
+		"upgraded":        upgraded,
+		"layout_mismatch": mismatched,
+	}
+}
+
+// amplificationSummary compares the response sizes of the versions that answered: which one sends back the most
+// bytes per byte sent, and which ones send more than they receive (oversized responses or extension fields)
+func amplificationSummary(results map[string]interface{}, versions []string) map[string]interface{} {
+	perVersion := map[string]interface{}{}
+	oversized := []string{}
+	maxFactor, maxVersion := 0.0, ""
+	for _, version := range versions {
+		info, ok := results[version].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		result, ok := info["result"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		factor, ok := result["amplification_factor"].(float64)
+		if !ok {
+			continue // no response
+		}
+		perVersion[version] = map[string]interface{}{
+			"request_bytes":        result["request_bytes"],
+			"response_bytes":       result["response_bytes"],
+			"response_datagrams":   result["response_datagrams"],
+			"amplification_factor": factor,
+		}
+		if factor > 1 {
+			oversized = append(oversized, version)
+		}
+		if factor > maxFactor {
+			maxFactor, maxVersion = factor, version
+		}
+	}
+	summary := map[string]interface{}{
+		"versions":                 perVersion,
+		"max_amplification_factor": maxFactor,
+		"oversized_responses":      oversized,
+	}
+	if maxVersion != "" {
+		summary["max_amplification_version"] = maxVersion
+	}
+	return summary
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NTP control messages (mode 6, RFC 1305 appendix B and RFC 9327), the protocol of ntpq. They read the variables of
+// the server (version, operating system, reference, peers...), so a server answering them to anyone discloses a lot
+// about its configuration. ntpd answers them by default unless "restrict ... noquery" is configured.
+//
+// Control message header (12 bytes), followed by the data (padded to 4 bytes, optionally followed by a MAC):
+//
+//	LI (2) | VN (3) | Mode = 6 (3)
+//	Response (1) | Error (1) | More (1) | Opcode (5)
+//	Sequence (16)
+//	Status (16)
+//	Association ID (16)
+//	Offset (16)
+//	Count (16)
+//
+// A long response is split in fragments with the same sequence number: the More bit is set in all of them but the
+// last, and offset/count tell where their data goes.
+
+const (
+	MODE_CONTROL             = 6
+	CONTROL_HEADER_SIZE      = 12
+	CONTROL_VERSION          = 2 // the version ntpq puts in its requests
+	CONTROL_OP_READSTAT      = 1
+	CONTROL_OP_READVAR       = 2
+	CONTROL_OP_READCLOCK     = 4
+	CONTROL_MAX_ASSOCIATIONS = 32 // peers whose variables are read
+)
+
+var controlOpcodeNames = map[uint8]string{
+	CONTROL_OP_READSTAT:  "READSTAT",
+	CONTROL_OP_READVAR:   "READVAR",
+	CONTROL_OP_READCLOCK: "READCLOCK",
+}
+
+// error codes of the status word of an error response (high byte)
+var controlErrorNames = []string{
+	"unspecified", "authentication failure", "invalid message length or format", "invalid opcode",
+	"unknown association ID", "unknown variable name", "invalid variable value", "administratively prohibited",
+}
+
+// clock sources of the system status word (RFC 1305)
+var controlClockSources = []string{
+	"unspecified", "calibrated atomic clock", "VLF or LF radio", "HF radio", "UHF radio", "local net",
+	"NTP", "UDP/TIME", "wristwatch", "modem",
+}
+
+// peer selection codes of the peer status word (as shown by ntpq)
+var controlPeerSelection = []string{
+	"reject", "falsetick", "excess", "outlier", "candidate", "backup", "sys.peer", "pps.peer",
+}
+
+// variables that tell something about the server to anyone who asks
+var controlDisclosureVariables = []string{"version", "system", "processor", "refid", "srcadr", "dstadr", "hostname"}
+
+func buildControlRequest(opcode uint8, sequence uint16, associationID uint16) []byte {
+	req := make([]byte, CONTROL_HEADER_SIZE)
+	req[0] = (0 << 6) | (CONTROL_VERSION << 3) | MODE_CONTROL
+	req[1] = opcode & 0x1f
+	binary.BigEndian.PutUint16(req[2:], sequence)
+	binary.BigEndian.PutUint16(req[6:], associationID)
+	return req
+}
+
+// controlResponse is a (reassembled) answer to one control request
+type controlResponse struct {
+	Status    uint16
+	Error     bool
+	Data      []byte
+	Fragments int
+	Size      int // bytes received, all datagrams included
+	Datagrams int
+}
+
+// controlQuery sends one control request and reassembles the fragments of its response
+func controlQuery(conn net.Conn, opcode uint8, sequence uint16, associationID uint16, timeout float64,
+	debug_output *strings.Builder) (controlResponse, int, error) {
+
+	r := controlResponse{}
+	req := buildControlRequest(opcode, sequence, associationID)
+	sentAt := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return r, 2, fmt.Errorf("could not send data: %v", err)
+	}
+	note := fmt.Sprintf("mode 6 %s", controlOpcodeNames[opcode])
+	pcapRecordNTP(conn, conn.RemoteAddr(), true, req, sentAt, note)
+	if err := conn.SetReadDeadline(time.Now().Add(time.Duration(timeout * float64(time.Second)))); err != nil {
+		return r, 3, fmt.Errorf("error reading bytes: %v", err)
+	}
+
+	fragments := map[int][]byte{}
+	end := -1 // length of the data, known when the last fragment arrives
+	for {
+		buf := make([]byte, 2048)
+		n, err := conn.Read(buf)
+		if err != nil {
+			if r.Fragments > 0 {
+				return r, 3, fmt.Errorf("incomplete response: %d fragments received before the timeout", r.Fragments)
+			}
+			return r, 3, fmt.Errorf("measurement timeout: %v", err)
+		}
+		resp := buf[:n]
+		pcapRecordNTP(conn, conn.RemoteAddr(), false, resp, time.Now(), note)
+		r.Size += n
+		r.Datagrams++
+		if n < CONTROL_HEADER_SIZE || resp[0]&0x7 != MODE_CONTROL || resp[1]&0x80 == 0 ||
+			resp[1]&0x1f != opcode || binary.BigEndian.Uint16(resp[2:4]) != sequence {
+			debug_output.WriteString(fmt.Sprintf("ignoring a datagram of %d bytes that is not a response to our request\n", n))
+			continue
+		}
+		r.Fragments++
+		r.Status = binary.BigEndian.Uint16(resp[4:6])
+		r.Error = resp[1]&0x40 != 0
+		offset := int(binary.BigEndian.Uint16(resp[8:10]))
+		count := int(binary.BigEndian.Uint16(resp[10:12]))
+		if CONTROL_HEADER_SIZE+count > n {
+			return r, 4, fmt.Errorf("fragment %d says %d bytes of data, but has only %d", r.Fragments, count, n-CONTROL_HEADER_SIZE)
+		}
+		fragments[offset] = resp[CONTROL_HEADER_SIZE : CONTROL_HEADER_SIZE+count]
+		if resp[1]&0x20 == 0 {
+			end = offset + count
+		}
+		if r.Error {
+			return r, 0, nil
+		}
+		if end >= 0 {
+			// complete if the fragments cover the data from 0 to end without holes
+			data := []byte{}
+			for len(data) < end {
+				fragment, ok := fragments[len(data)]
+				if !ok || len(fragment) == 0 {
+					break
+				}
+				data = append(data, fragment...)
+			}
+			if len(data) == end {
+				r.Data = data
+				return r, 0, nil
+			}
+		}
+	}
+}
+
+// parseControlVariables parses the "name=value, name="quoted, value", flag" text of READVAR and READCLOCK
+func parseControlVariables(data []byte) map[string]string {
+	variables := map[string]string{}
+	text := strings.TrimRight(string(data), "\x00")
+	var field strings.Builder
+	quoted := false
+	add := func() {
+		f := strings.TrimSpace(field.String())
+		field.Reset()
+		if f == "" {
+			return
+		}
+		name, value, _ := strings.Cut(f, "=")
+		variables[strings.TrimSpace(name)] = strings.Trim(strings.TrimSpace(value), "\"")
+	}
+	for _, c := range text {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			field.WriteRune(c)
+		case c == ',' && !quoted:
+			add()
+		case c == '\r' || c == '\n':
+			field.WriteRune(' ')
+		default:
+			field.WriteRune(c)
+		}
+	}
+	add()
+	return variables
+}
+
+// decodeSystemStatus decodes the system status word: LI (2), clock source (6), event count (4), last event (4)
+func decodeSystemStatus(status uint16) map[string]interface{} {
+	source := int(status>>8) & 0x3f
+	info := map[string]interface{}{
+		"status_raw":   status,
+		"leap":         status >> 14,
+		"clock_source": source,
+		"event_count":  (status >> 4) & 0xf,
+		"last_event":   status & 0xf,
+	}
+	if source < len(controlClockSources) {
+		info["clock_source_name"] = controlClockSources[source]
+	}
+	return info
+}
+
+// decodePeerStatus decodes the peer status word: configured, authentication enabled, authentic, reachable,
+// broadcast (5 bits), selection (3), event count (4), last event (4)
+func decodePeerStatus(associationID uint16, status uint16) map[string]interface{} {
+	return map[string]interface{}{
+		"association_id": associationID,
+		"status_raw":     status,
+		"configured":     status&0x8000 != 0,
+		"auth_enabled":   status&0x4000 != 0,
+		"authentic":      status&0x2000 != 0,
+		"reachable":      status&0x1000 != 0,
+		"broadcast":      status&0x0800 != 0,
+		"selection":      controlPeerSelection[(status>>8)&0x7],
+		"event_count":    (status >> 4) & 0xf,
+		"last_event":     status & 0xf,
+	}
+}
+
+func controlErrorName(status uint16) string {
+	code := int(status >> 8)
+	if code < len(controlErrorNames) {
+		return controlErrorNames[code]
+	}
+	return fmt.Sprintf("error %d", code)
+}
+
+// performMode6Measurement reads with control messages the system variables, the associations (and the variables of
+// each peer) and the reference clock variables of a server, as "ntpq -c rv -c as -c cv" does. It reports if the
+// server answers unauthenticated control queries and which variables it discloses. Every query is sent once.
+func performMode6Measurement(server string, timeout float64, opts MeasurementOptions) (map[string]interface{}, string, int) {
+	var output strings.Builder
+	error_message := map[string]interface{}{}
+	addr := net.JoinHostPort(server, strconv.Itoa(123))
+
+	conn, err := dialNTP(addr, timeout, opts)
+	if err != nil {
+		m := fmt.Sprintf("error connecting: %v\n", err)
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 1
+	}
+	defer func(conn net.Conn) {
+		err := conn.Close()
+		if err != nil {
+			return
+		}
+	}(conn)
+	measuredIP := conn.RemoteAddr().(*net.UDPAddr).IP.String()
+
+	seq := make([]byte, 2)
+	_, _ = rand.Read(seq)
+	sequence := binary.BigEndian.Uint16(seq)
+	queries := []map[string]interface{}{}
+	requestBytes, responseBytes, responseDatagrams := 0, 0, 0
+	answered, rejected, lastCode := 0, 0, 0
+	query := func(opcode uint8, associationID uint16) (controlResponse, bool) {
+		if len(queries) > 0 {
+			time.Sleep(100 * time.Millisecond) // do not spam the server
+		}
+		sequence++
+		output.WriteString(fmt.Sprintf("%s association %d (sequence %d)\n", controlOpcodeNames[opcode], associationID, sequence))
+		r, code, err := controlQuery(conn, opcode, sequence, associationID, timeout, &output)
+		requestBytes += CONTROL_HEADER_SIZE
+		responseBytes += r.Size
+		responseDatagrams += r.Datagrams
+		q := map[string]interface{}{
+			"opcode":         controlOpcodeNames[opcode],
+			"association_id": associationID,
+			"answered":       err == nil,
+			"fragments":      r.Fragments,
+			"response_size":  r.Size,
+		}
+		queries = append(queries, q)
+		if err != nil {
+			output.WriteString(fmt.Sprintf("%v\n", err))
+			q["error"] = err.Error()
+			lastCode = code
+			return r, false
+		}
+		if r.Error {
+			rejected++
+			q["error"] = controlErrorName(r.Status)
+			output.WriteString(fmt.Sprintf("error response: %s\n", q["error"]))
+			return r, false
+		}
+		answered++
+		return r, true
+	}
+
+	result := map[string]interface{}{
+		"Host":               server,
+		"Measured server IP": measuredIP,
+	}
+	disclosed := map[string]string{}
+	if r, ok := query(CONTROL_OP_READVAR, 0); ok {
+		variables := parseControlVariables(r.Data)
+		result["system_variables"] = variables
+		result["system_status"] = decodeSystemStatus(r.Status)
+		for _, name := range controlDisclosureVariables {
+			if value, ok := variables[name]; ok {
+				disclosed[name] = value
+			}
+		}
+	}
+	associations := []map[string]interface{}{}
+	if r, ok := query(CONTROL_OP_READSTAT, 0); ok {
+		for i := 0; i+4 <= len(r.Data); i += 4 {
+			associations = append(associations, decodePeerStatus(binary.BigEndian.Uint16(r.Data[i:]),
+				binary.BigEndian.Uint16(r.Data[i+2:])))
+		}
+		result["associations"] = associations
+	}
+	peers := []string{}
+	for i, association := range associations {
+		if i >= CONTROL_MAX_ASSOCIATIONS {
+			output.WriteString(fmt.Sprintf("%d associations, only the variables of the first %d are read\n",
+				len(associations), CONTROL_MAX_ASSOCIATIONS))
+			break
+		}
+		if r, ok := query(CONTROL_OP_READVAR, association["association_id"].(uint16)); ok {
+			variables := parseControlVariables(r.Data)
+			association["variables"] = variables
+			if address, ok := variables["srcadr"]; ok {
+				peers = append(peers, address)
+			}
+		}
+	}
+	if r, ok := query(CONTROL_OP_READCLOCK, 0); ok {
+		result["clock_variables"] = parseControlVariables(r.Data)
+	}
+
+	if answered == 0 && rejected == 0 {
+		m := "the server did not answer any control query (mode 6 disabled or filtered)\n"
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), lastCode
+	}
+	if len(peers) > 0 {
+		sort.Strings(peers)
+		disclosed["peers"] = strings.Join(peers, ", ")
+	}
+	// only the queries answered without an error count: error responses (authentication required, prohibited...)
+	// show that mode 6 is there, but nothing is disclosed
+	result["answers_control_queries"] = answered > 0
+	result["rejected"] = rejected
+	result["disclosed"] = disclosed
+	result["queries"] = queries
+	addAmplification(result, requestBytes, responseBytes, responseDatagrams)
+	return result, output.String(), 0
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mode 7 (ntpd private mode, the protocol of ntpdc) audit. MON_GETLIST asks ntpd for its monitor list (the last
+// clients that contacted it), up to 600 entries in many datagrams for a 48-byte request: that is why it was used for
+// reflection/amplification attacks (CVE-2013-5211). ntpd 4.2.7p26 and later do not answer it, and "disable monitor"
+// or "restrict default noquery" turn it off in older versions.
+//
+// The audit sends ONE request to ONE server named explicitly (no ranges or lists) and never repeats it. It counts
+// what comes back (datagrams, bytes, monitor entries) but does not decode the entries, which contain the addresses
+// of other clients of the server.
+//
+// Request header (8 bytes), followed by 40 bytes of data (all 0 here):
+//
+//	Response (1) | More (1) | VN (3) | Mode = 7 (3)
+//	Authenticated (1) | Sequence (7)
+//	Implementation
+//	Request code
+//	Error (4) | Number of items (12)
+//	MBZ (4) | Item size (12)
+
+const (
+	MODE_PRIVATE            = 7
+	PRIVATE_HEADER_SIZE     = 8
+	PRIVATE_REQUEST_SIZE    = 48 // header and 40 bytes of data, as sent by ntpdc
+	PRIVATE_VERSION         = 2
+	PRIVATE_IMPL_XNTPD      = 3
+	PRIVATE_REQ_MON_GETLIST = 42 // MON_GETLIST_1
+)
+
+// error codes of mode 7 responses
+var privateErrorNames = []string{
+	"no error", "implementation not supported", "request not supported", "format error", "no data available",
+	"unknown error 5", "unknown error 6", "authentication failure",
+}
+
+// checkAuditTarget refuses anything that is not one explicit server: lists, ranges, wildcards, broadcast,
+// multicast and unspecified addresses
+func checkAuditTarget(host string) error {
+	if host == "" || strings.ContainsAny(host, "/,* \t") {
+		return fmt.Errorf("%q is not a single server: name exactly one host or IP address", host)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsMulticast() || ip.IsUnspecified() || ip.Equal(net.IPv4bcast) {
+			return fmt.Errorf("%s is not a single server (broadcast, multicast or unspecified address)", host)
+		}
+	}
+	return nil
+}
+
+func buildMonlistRequest() []byte {
+	req := make([]byte, PRIVATE_REQUEST_SIZE)
+	req[0] = (PRIVATE_VERSION << 3) | MODE_PRIVATE
+	req[2] = PRIVATE_IMPL_XNTPD
+	req[3] = PRIVATE_REQ_MON_GETLIST
+	return req
+}
+
+// performMode7Audit sends one MON_GETLIST request and reports if the server answers, the size of the answer and the
+// amplification factor (bytes received / bytes sent). A server that does not answer is the expected (remediated)
+// result, not an error.
+func performMode7Audit(server string, timeout float64, opts MeasurementOptions) (map[string]interface{}, string, int) {
+	var output strings.Builder
+	error_message := map[string]interface{}{}
+	if err := checkAuditTarget(server); err != nil {
+		m := fmt.Sprintf("%v\n", err)
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 1
+	}
+	addr := net.JoinHostPort(server, strconv.Itoa(123))
+
+	conn, err := dialNTP(addr, timeout, opts)
+	if err != nil {
+		m := fmt.Sprintf("error connecting: %v\n", err)
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 1
+	}
+	defer func(conn net.Conn) {
+		err := conn.Close()
+		if err != nil {
+			return
+		}
+	}(conn)
+	measuredIP := conn.RemoteAddr().(*net.UDPAddr).IP.String()
+	if err := checkAuditTarget(measuredIP); err != nil {
+		m := fmt.Sprintf("%v\n", err)
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 1
+	}
+
+	req := buildMonlistRequest()
+	note := "mode 7 MON_GETLIST audit"
+	sentAt := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		m := fmt.Sprintf("could not send data: %v\n", err)
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 2
+	}
+	pcapRecordNTP(conn, conn.RemoteAddr(), true, req, sentAt, note)
+	output.WriteString(fmt.Sprintf("sent one MON_GETLIST request (%d bytes) to %s, listening for %v s\n", len(req), measuredIP, timeout))
+	if err := conn.SetReadDeadline(time.Now().Add(time.Duration(timeout * float64(time.Second)))); err != nil {
+		m := fmt.Sprintf("error reading bytes: %v\n", err)
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 3
+	}
+
+	// listen until the timeout: the list comes in many datagrams
+	datagrams, responseBytes, entries, other := 0, 0, 0, 0 // all datagrams count for the amplification
+	errorCode := 0
+	for {
+		buf := make([]byte, 2048)
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		resp := buf[:n]
+		pcapRecordNTP(conn, conn.RemoteAddr(), false, resp, time.Now(), note)
+		datagrams++
+		responseBytes += n
+		if n < PRIVATE_HEADER_SIZE || resp[0]&0x7 != MODE_PRIVATE || resp[0]&0x80 == 0 || resp[3] != PRIVATE_REQ_MON_GETLIST {
+			other++
+			continue
+		}
+		errorCode = int(resp[4] >> 4)
+		entries += int(binary.BigEndian.Uint16(resp[4:6]) & 0x0fff)
+	}
+	output.WriteString(fmt.Sprintf("%d datagrams (%d not mode 7 responses), %d bytes, %d monitor entries\n", datagrams, other, responseBytes, entries))
+
+	result := map[string]interface{}{
+		"Host":               server,
+		"Measured server IP": measuredIP,
+		"request":            "MON_GETLIST_1",
+		"requests_sent":      1,
+		"replies":            datagrams > other,
+		"other_datagrams":    other, // datagrams that are not mode 7 responses to MON_GETLIST
+	}
+	addAmplification(result, len(req), responseBytes, datagrams)
+	if datagrams > other {
+		result["monitor_entries"] = entries
+		if errorCode < len(privateErrorNames) {
+			result["response_error"] = privateErrorNames[errorCode]
+		}
+		// an error response (for example "request not supported") is small, a monitor list is what amplifies
+		result["vulnerable"] = entries > 0
+	} else {
+		result["vulnerable"] = false
+	}
+	return result, output.String(), 0
+}
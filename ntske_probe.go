@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NTS-KE AEAD probe. The NTS library always offers AEAD_AES_SIV_CMAC_256, so to know which AEAD algorithms a server
+// supports we do our own key exchange (RFC 8915, section 4) offering only one algorithm at a time: the server
+// answers with the algorithm it chose, or with none (or an error) if it does not support it.
+//
+// NTS-KE record: Critical (1) | Type (15), Body length (16), Body
+
+const (
+	NTSKE_PORT              = 4460
+	NTSKE_ALPN              = "ntske/1"
+	NTSKE_CRITICAL          = 0x8000
+	NTSKE_REC_EOM           = 0
+	NTSKE_REC_NEXT_PROTOCOL = 1
+	NTSKE_REC_ERROR         = 2
+	NTSKE_REC_WARNING       = 3
+	NTSKE_REC_AEAD          = 4
+	NTSKE_REC_COOKIE        = 5
+	NTSKE_REC_SERVER        = 6
+	NTSKE_REC_PORT          = 7
+	NTSKE_PROTOCOL_NTPV4    = 0
+)
+
+// AEAD algorithms of the IANA registry that can be used with NTS
+var ntsAEADAlgorithms = []struct {
+	id   uint16
+	name string
+}{
+	{15, "AEAD_AES_SIV_CMAC_256"},
+	{16, "AEAD_AES_SIV_CMAC_384"},
+	{17, "AEAD_AES_SIV_CMAC_512"},
+	{30, "AEAD_AES_128_GCM_SIV"},
+	{31, "AEAD_AES_256_GCM_SIV"},
+}
+
+// ntsAEADName returns the name of an AEAD algorithm id
+func ntsAEADName(id uint16) string {
+	for _, algorithm := range ntsAEADAlgorithms {
+		if algorithm.id == id {
+			return algorithm.name
+		}
+	}
+	return fmt.Sprintf("AEAD %d", id)
+}
+
+// describeNTSKERecords lists the records of one direction of an NTS-KE connection in a readable form. Cookies are
+// only counted (with their lengths): they are secrets of the session
+func describeNTSKERecords(stream []byte) []string {
+	records := []string{}
+	cookieLengths := []string{}
+	for len(stream) >= 4 {
+		recordType := binary.BigEndian.Uint16(stream) &^ NTSKE_CRITICAL
+		length := int(binary.BigEndian.Uint16(stream[2:]))
+		if 4+length > len(stream) {
+			records = append(records, fmt.Sprintf("truncated record (type %d)", recordType))
+			break
+		}
+		body := stream[4 : 4+length]
+		stream = stream[4+length:]
+		switch recordType {
+		case NTSKE_REC_EOM:
+			records = append(records, "end of message")
+		case NTSKE_REC_NEXT_PROTOCOL:
+			protocols := []string{}
+			for i := 0; i+2 <= len(body); i += 2 {
+				if id := binary.BigEndian.Uint16(body[i:]); id == NTSKE_PROTOCOL_NTPV4 {
+					protocols = append(protocols, "NTPv4")
+				} else {
+					protocols = append(protocols, fmt.Sprintf("protocol %d", id))
+				}
+			}
+			records = append(records, "next protocol: "+strings.Join(protocols, ", "))
+		case NTSKE_REC_AEAD:
+			algorithms := []string{}
+			for i := 0; i+2 <= len(body); i += 2 {
+				algorithms = append(algorithms, ntsAEADName(binary.BigEndian.Uint16(body[i:])))
+			}
+			records = append(records, "AEAD: "+strings.Join(algorithms, ", "))
+		case NTSKE_REC_ERROR, NTSKE_REC_WARNING:
+			name := "error"
+			if recordType == NTSKE_REC_WARNING {
+				name = "warning"
+			}
+			if len(body) >= 2 {
+				records = append(records, fmt.Sprintf("%s %d", name, binary.BigEndian.Uint16(body)))
+			} else {
+				records = append(records, name)
+			}
+		case NTSKE_REC_COOKIE:
+			cookieLengths = append(cookieLengths, strconv.Itoa(len(body)))
+		case NTSKE_REC_SERVER:
+			records = append(records, "NTPv4 server: "+string(body))
+		case NTSKE_REC_PORT:
+			if len(body) >= 2 {
+				records = append(records, fmt.Sprintf("NTPv4 port: %d", binary.BigEndian.Uint16(body)))
+			}
+		default:
+			records = append(records, fmt.Sprintf("record type %d (%d bytes)", recordType, length))
+		}
+	}
+	if len(cookieLengths) > 0 {
+		records = append(records, fmt.Sprintf("%d cookies (bytes: %s)", len(cookieLengths), strings.Join(cookieLengths, ", ")))
+	}
+	return records
+}
+
+func appendNTSKERecord(buf *bytes.Buffer, recordType uint16, body []byte) {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint16(header, recordType)
+	binary.BigEndian.PutUint16(header[2:], uint16(len(body)))
+	buf.Write(header)
+	buf.Write(body)
+}
+
+// probeNTSAEAD does one NTS-KE offering only the given AEAD algorithm and returns what the server answered: the
+// chosen algorithm (if any), the error code (if any) and the number of cookies
+func probeNTSAEAD(host string, timeout float64, algorithm uint16) (map[string]interface{}, error) {
+	tlsConfig := &tls.Config{
+		ServerName: host,
+		NextProtos: []string{NTSKE_ALPN},
+		MinVersion: tls.VersionTLS13,
+	}
+	if net.ParseIP(host) != nil {
+		tlsConfig.InsecureSkipVerify = true // as in measureSpecificIP, the certificate cannot be checked for an IP
+	}
+	deadline := time.Duration(timeout * float64(time.Second))
+	conn, err := ntsKEDial(&net.Dialer{Timeout: deadline}, "tcp", net.JoinHostPort(host, strconv.Itoa(NTSKE_PORT)), tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("key exchange failure: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(deadline))
+
+	var req bytes.Buffer
+	protocol := make([]byte, 2)
+	binary.BigEndian.PutUint16(protocol, NTSKE_PROTOCOL_NTPV4)
+	appendNTSKERecord(&req, NTSKE_CRITICAL|NTSKE_REC_NEXT_PROTOCOL, protocol)
+	aead := make([]byte, 2)
+	binary.BigEndian.PutUint16(aead, algorithm)
+	appendNTSKERecord(&req, NTSKE_REC_AEAD, aead)
+	appendNTSKERecord(&req, NTSKE_CRITICAL|NTSKE_REC_EOM, nil)
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		return nil, fmt.Errorf("could not send the key exchange request: %v", err)
+	}
+
+	info := map[string]interface{}{"cookies": 0}
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return info, fmt.Errorf("key exchange response ended without end of message: %v", err)
+		}
+		recordType := binary.BigEndian.Uint16(header) &^ NTSKE_CRITICAL
+		body := make([]byte, binary.BigEndian.Uint16(header[2:]))
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return info, fmt.Errorf("truncated key exchange record: %v", err)
+		}
+		switch recordType {
+		case NTSKE_REC_EOM:
+			return info, nil
+		case NTSKE_REC_AEAD:
+			if len(body) >= 2 {
+				info["aead"] = binary.BigEndian.Uint16(body)
+			}
+		case NTSKE_REC_ERROR:
+			if len(body) >= 2 {
+				info["error_code"] = binary.BigEndian.Uint16(body)
+			}
+		case NTSKE_REC_WARNING:
+			if len(body) >= 2 {
+				info["warning_code"] = binary.BigEndian.Uint16(body)
+			}
+		case NTSKE_REC_COOKIE:
+			info["cookies"] = info["cookies"].(int) + 1
+		}
+	}
+}
+
+// probeNTSAEADs tries every AEAD algorithm (one key exchange each) and tells which ones the server accepts
+func probeNTSAEADs(host string, timeout float64, debug_output *strings.Builder) map[string]interface{} {
+	supported := map[string]interface{}{}
+	for i, algorithm := range ntsAEADAlgorithms {
+		if i > 0 {
+			time.Sleep(300 * time.Millisecond) // do not spam the server
+		}
+		info, err := probeNTSAEAD(host, timeout, algorithm.id)
+		if err != nil {
+			debug_output.WriteString(fmt.Sprintf("NTS-KE with %s: %v\n", algorithm.name, err))
+			supported[algorithm.name] = false
+			continue
+		}
+		debug_output.WriteString(fmt.Sprintf("NTS-KE with %s: %v\n", algorithm.name, info))
+		supported[algorithm.name] = info["aead"] == algorithm.id && info["error_code"] == nil
+	}
+	return supported
+}
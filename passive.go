@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Passive measurement ("passive" command): from a capture of the NTP traffic between our clients and servers, every
+// response is paired with its request (origin timestamp, or client cookie in NTPv5) and offset and rtt are computed
+// with the capture timestamps of the two packets (t1 and t4) and the server timestamps of the response (t2 and t3).
+// The capture should be taken on the client side (or near it), otherwise the network delay between the capture point
+// and the client is not included.
+
+// performPassiveMeasurement reads a pcap/pcapng file and returns the result of every exchange and statistics per
+// server. The codes are as in decode (1 -> the file cannot be read, 4 -> no complete exchange found).
+func performPassiveMeasurement(path string, draft string) (map[string]interface{}, string, int) {
+	var output strings.Builder
+	error_message := map[string]interface{}{}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		m := fmt.Sprintf("could not read the capture: %v\n", err)
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 1
+	}
+	packets, isCapture, err := readCapture(data)
+	if !isCapture {
+		m := fmt.Sprintf("%s is not a pcap or pcapng file\n", path)
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 1
+	}
+	if err != nil {
+		output.WriteString(fmt.Sprintf("error reading the capture: %v\n", err))
+	}
+	datagrams := ntpDatagramsInCapture(packets)
+	output.WriteString(fmt.Sprintf("%d frames, %d NTP datagrams (UDP port 123)\n", len(packets), len(datagrams)))
+
+	exchanges := []map[string]interface{}{}
+	answered := map[int]bool{}
+	offsets := map[string][]float64{}
+	rtts := map[string][]float64{}
+	requests := map[string]int{}
+	responses := map[string]int{}
+	servers := []string{}
+	for i, d := range datagrams {
+		mode := packetMode(d.payload)
+		if mode == MODE_CLIENT || isSymmetricMode(mode) {
+			// client request, whatever its source port. A symmetric packet is a request to the peer and can also be
+			// the answer to the previous packet of the peer
+			server := d.dst.IP.String()
+			if _, ok := requests[server]; !ok {
+				servers = append(servers, server)
+			}
+			requests[server]++
+			if mode == MODE_CLIENT {
+				continue
+			}
+		}
+		j := findRequest(datagrams, i)
+		if j < 0 || answered[j] {
+			continue // no request, or a duplicate response
+		}
+		answered[j] = true
+		r := datagrams[j]
+		clientCookie := uint64(0)
+		if len(r.payload) >= 32 {
+			clientCookie = binary.BigEndian.Uint64(r.payload[24:32])
+		}
+		t1, t4 := timeToNtpUint64(r.time), timeToNtpUint64(d.time)
+		result, err := parseNTPPacket(d.payload, t1, t4, clientCookie, draft, &output)
+		if err != nil {
+			output.WriteString(fmt.Sprintf("frame %d: error parsing response: %v\n", d.index, err))
+			continue
+		}
+		server := d.src.IP.String()
+		responses[server]++
+		exchange := map[string]interface{}{
+			"server":           d.src.String(),
+			"client":           d.dst.String(),
+			"request_frame":    r.index,
+			"response_frame":   d.index,
+			"version":          result["version"],
+			"stratum":          result["stratum"],
+			"client_sent_time": t1,
+			"client_recv_time": t4,
+		}
+		// an interleaved response (NTPv4: our receive timestamp as origin, NTPv5: the interleaved flag) has the
+		// transmit timestamp of the previous exchange, so offset and rtt of this pair would be wrong
+		interleaved := false
+		if (r.payload[0]>>3)&0x7 == NTPV5_VERSION {
+			flags, _ := result["flags_decoded"].(map[string]bool)
+			interleaved = flags["interleaved"]
+		} else {
+			interleaved = !bytes.Equal(d.payload[24:32], r.payload[40:48])
+		}
+		if interleaved {
+			exchange["interleaved_response"] = true
+		} else {
+			for _, key := range []string{"offset", "rtt", "offset_ns", "rtt_ns"} {
+				exchange[key] = result[key]
+			}
+			offsets[server] = append(offsets[server], result["offset"].(float64))
+			rtts[server] = append(rtts[server], result["rtt"].(float64))
+		}
+		if anomaly, ok := result["anomaly"]; ok {
+			exchange["anomaly"] = anomaly
+		}
+		exchanges = append(exchanges, exchange)
+	}
+	if len(exchanges) == 0 {
+		m := fmt.Sprintf("no complete NTP exchange (request and response) found in %d datagrams\n", len(datagrams))
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 4
+	}
+
+	perServer := map[string]interface{}{}
+	for _, server := range servers {
+		stats := map[string]interface{}{
+			"requests":   requests[server],
+			"exchanges":  responses[server],
+			"unanswered": requests[server] - responses[server],
+		}
+		if len(offsets[server]) > 0 {
+			stats["offset"] = sampleStatistics(offsets[server])
+			stats["rtt"] = sampleStatistics(rtts[server])
+		}
+		perServer[server] = stats
+	}
+	return map[string]interface{}{
+		"capture":       path,
+		"frames":        len(packets),
+		"ntp_datagrams": len(datagrams),
+		"exchanges":     exchanges,
+		"servers":       perServer,
+	}, output.String(), 0
+}
+
+// sampleStatistics describes a list of values (seconds)
+func sampleStatistics(values []float64) map[string]interface{} {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	sum := 0.0
+	for _, v := range sorted {
+		sum += v
+	}
+	mean := sum / float64(n)
+	variance := 0.0
+	for _, v := range sorted {
+		variance += (v - mean) * (v - mean)
+	}
+	stddev := 0.0
+	if n > 1 {
+		stddev = math.Sqrt(variance / float64(n-1))
+	}
+	median := sorted[n/2]
+	if n%2 == 0 {
+		median = (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+	return map[string]interface{}{
+		"count":  n,
+		"min":    sorted[0],
+		"max":    sorted[n-1],
+		"mean":   mean,
+		"median": median,
+		"stddev": stddev,
+	}
+}
@@ -0,0 +1,618 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Export of the measurement traffic as a pcapng file (-pcap), to attach to bug reports for server operators. We do
+// not capture on the interface: the packets are the payloads that we send and receive, with synthesized Ethernet,
+// IP and UDP (or TCP) headers. Every packet has a comment with the measurement id, which is also in the result.
+//
+// With -pcap-ke the NTS-KE connection is also written (as TCP segments, still encrypted). The TLS secrets are never
+// written: with them anyone who has the file could derive the NTS keys of the session. Instead we decrypt the NTS-KE
+// records ourselves (TLS 1.3 with AES-GCM) and write what they say (next protocol, AEAD, server, port, number and
+// lengths of the cookies, but not the cookies) as the comment of the last segment.
+
+const (
+	PCAPNG_BLOCK_SHB = 0x0A0D0D0A
+	PCAPNG_BLOCK_IDB = 0x00000001
+	PCAPNG_BLOCK_SPB = 0x00000003
+	PCAPNG_BLOCK_EPB = 0x00000006
+
+	PCAPNG_BYTE_ORDER_MAGIC  = 0x1A2B3C4D
+	PCAPNG_LINKTYPE_ETHERNET = 1
+	PCAPNG_OPT_COMMENT       = 1
+	PCAPNG_OPT_IF_TSRESOL    = 9
+
+	TCP_FLAG_FIN = 0x01
+	TCP_FLAG_SYN = 0x02
+	TCP_FLAG_PSH = 0x08
+	TCP_FLAG_ACK = 0x10
+)
+
+// synthesized MAC addresses (locally administered)
+var (
+	pcapLocalMAC  = []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	pcapRemoteMAC = []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+)
+
+// measurementID identifies this run of the tool, in the result and in the pcap comments
+var measurementID = newMeasurementID()
+
+// pcapCapture is the pcapng file we export to, or nil if -pcap was not given
+var pcapCapture *pcapWriter
+
+type pcapWriter struct {
+	mu        sync.Mutex
+	f         *os.File
+	includeKE bool
+}
+
+func newMeasurementID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// openPcap creates the file and writes the section header and the (only) interface description. The packets are
+// written directly to the file (not buffered), so that what was measured is in the file even if the tool is stopped.
+func openPcap(path string, includeKE bool) (*pcapWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &pcapWriter{f: f, includeKE: includeKE}
+
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:4], PCAPNG_BYTE_ORDER_MAGIC)
+	binary.LittleEndian.PutUint16(shb[4:6], 1) // version 1.0
+	binary.LittleEndian.PutUint16(shb[6:8], 0)
+	binary.LittleEndian.PutUint64(shb[8:16], 0xFFFFFFFFFFFFFFFF) // section length not specified
+	shb = append(shb, pcapOption(PCAPNG_OPT_COMMENT, []byte("ntp_nts_tool measurement "+measurementID))...)
+	shb = append(shb, 0, 0, 0, 0) // end of options
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:2], PCAPNG_LINKTYPE_ETHERNET)
+	binary.LittleEndian.PutUint32(idb[4:8], 65535)                     // snap length
+	idb = append(idb, pcapOption(PCAPNG_OPT_IF_TSRESOL, []byte{9})...) // nanoseconds
+	idb = append(idb, 0, 0, 0, 0)
+
+	if err := p.writeBlock(PCAPNG_BLOCK_SHB, shb); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := p.writeBlock(PCAPNG_BLOCK_IDB, idb); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// close closes the file (main closes it when the measurement is finished)
+func (p *pcapWriter) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_ = p.f.Close()
+}
+
+// pcapOption encodes one option (code, length, value padded to 4 bytes)
+func pcapOption(code uint16, value []byte) []byte {
+	opt := make([]byte, 4+(len(value)+3)&^3)
+	binary.LittleEndian.PutUint16(opt[0:2], code)
+	binary.LittleEndian.PutUint16(opt[2:4], uint16(len(value)))
+	copy(opt[4:], value)
+	return opt
+}
+
+// writeBlock writes a block with its type and (repeated) total length. The body must be padded to 4 bytes.
+func (p *pcapWriter) writeBlock(blockType uint32, body []byte) error {
+	total := 12 + len(body)
+	block := make([]byte, total)
+	binary.LittleEndian.PutUint32(block[0:4], blockType)
+	binary.LittleEndian.PutUint32(block[4:8], uint32(total))
+	copy(block[8:], body)
+	binary.LittleEndian.PutUint32(block[total-4:], uint32(total))
+	_, err := p.f.Write(block)
+	return err
+}
+
+// writeFrame writes one Ethernet frame as an Enhanced Packet Block with a comment
+func (p *pcapWriter) writeFrame(frame []byte, ts time.Time, comment string) {
+	body := make([]byte, 20)
+	nanos := uint64(ts.UnixNano())
+	binary.LittleEndian.PutUint32(body[0:4], 0) // interface id
+	binary.LittleEndian.PutUint32(body[4:8], uint32(nanos>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(nanos))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(len(frame)))
+	body = append(body, frame...)
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	body = append(body, pcapOption(PCAPNG_OPT_COMMENT, []byte(comment))...)
+	body = append(body, 0, 0, 0, 0)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_ = p.writeBlock(PCAPNG_BLOCK_EPB, body)
+}
+
+// writeUDP writes a datagram that we sent (outgoing) or received
+func (p *pcapWriter) writeUDP(local *net.UDPAddr, remote *net.UDPAddr, outgoing bool, payload []byte, ts time.Time, comment string) {
+	src, dst := local, remote
+	if !outgoing {
+		src, dst = remote, local
+	}
+	udp := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:4], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:6], uint16(8+len(payload)))
+	udp = append(udp, payload...)
+	binary.BigEndian.PutUint16(udp[6:8], transportChecksum(src.IP, dst.IP, 17, udp))
+	p.writeFrame(ethernetIPFrame(src.IP, dst.IP, 17, udp, outgoing), ts, comment)
+}
+
+// writeTCP writes a TCP segment that we sent (outgoing) or received
+func (p *pcapWriter) writeTCP(local *net.TCPAddr, remote *net.TCPAddr, outgoing bool, seq uint32, ack uint32,
+	flags byte, payload []byte, ts time.Time, comment string) {
+	src, dst := local, remote
+	if !outgoing {
+		src, dst = remote, local
+	}
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:4], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	binary.BigEndian.PutUint32(tcp[8:12], ack)
+	tcp[12] = 5 << 4 // header length, no options
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:16], 65535) // window
+	tcp = append(tcp, payload...)
+	binary.BigEndian.PutUint16(tcp[16:18], transportChecksum(src.IP, dst.IP, 6, tcp))
+	p.writeFrame(ethernetIPFrame(src.IP, dst.IP, 6, tcp, outgoing), ts, comment)
+}
+
+// ethernetIPFrame adds the IPv4 or IPv6 header and the Ethernet header to a UDP/TCP segment
+func ethernetIPFrame(src net.IP, dst net.IP, protocol byte, segment []byte, outgoing bool) []byte {
+	frame := make([]byte, 14)
+	if outgoing {
+		copy(frame[0:6], pcapRemoteMAC)
+		copy(frame[6:12], pcapLocalMAC)
+	} else {
+		copy(frame[0:6], pcapLocalMAC)
+		copy(frame[6:12], pcapRemoteMAC)
+	}
+	if src.To4() != nil && dst.To4() != nil {
+		binary.BigEndian.PutUint16(frame[12:14], 0x0800)
+		ip := make([]byte, 20)
+		ip[0] = 0x45 // version 4, 20 bytes header
+		binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(segment)))
+		ip[6] = 0x40 // don't fragment
+		ip[8] = 64   // TTL
+		ip[9] = protocol
+		copy(ip[12:16], src.To4())
+		copy(ip[16:20], dst.To4())
+		binary.BigEndian.PutUint16(ip[10:12], internetChecksum(ip, 0))
+		frame = append(frame, ip...)
+	} else {
+		binary.BigEndian.PutUint16(frame[12:14], 0x86DD)
+		ip := make([]byte, 40)
+		ip[0] = 0x60 // version 6
+		binary.BigEndian.PutUint16(ip[4:6], uint16(len(segment)))
+		ip[6] = protocol
+		ip[7] = 64 // hop limit
+		copy(ip[8:24], src.To16())
+		copy(ip[24:40], dst.To16())
+		frame = append(frame, ip...)
+	}
+	return append(frame, segment...)
+}
+
+// internetChecksum is the ones' complement sum of RFC 1071, starting from an initial (pseudo header) sum
+func internetChecksum(data []byte, initial uint32) uint16 {
+	sum := initial
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i : i+2]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// transportChecksum is the UDP/TCP checksum, including the IPv4 or IPv6 pseudo header
+func transportChecksum(src net.IP, dst net.IP, protocol byte, segment []byte) uint16 {
+	var pseudo []byte
+	if src.To4() != nil && dst.To4() != nil {
+		pseudo = append(append([]byte{}, src.To4()...), dst.To4()...)
+		pseudo = append(pseudo, 0, protocol, byte(len(segment)>>8), byte(len(segment)))
+	} else {
+		pseudo = append(append([]byte{}, src.To16()...), dst.To16()...)
+		length := len(segment)
+		pseudo = append(pseudo, byte(length>>24), byte(length>>16), byte(length>>8), byte(length), 0, 0, 0, protocol)
+	}
+	sum := uint32(0)
+	for i := 0; i < len(pseudo); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(pseudo[i : i+2]))
+	}
+	checksum := internetChecksum(segment, sum)
+	if checksum == 0 && protocol == 17 {
+		return 0xFFFF // 0 means "no checksum" in UDP
+	}
+	return checksum
+}
+
+// pcapLocalUDPAddr returns our address as seen by the server. An unconnected socket is bound to the unspecified
+// address, so we ask the kernel which source address it would use for this server (no packet is sent).
+func pcapLocalUDPAddr(local net.Addr, remote *net.UDPAddr) *net.UDPAddr {
+	addr, _ := local.(*net.UDPAddr)
+	if addr == nil {
+		addr = &net.UDPAddr{}
+	}
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		if probe, err := net.DialUDP("udp", nil, remote); err == nil {
+			addr = &net.UDPAddr{IP: probe.LocalAddr().(*net.UDPAddr).IP, Port: addr.Port}
+			probe.Close()
+		}
+	}
+	return addr
+}
+
+// pcapRecordNTP writes an NTP (or NTS) datagram to the pcap file, if we export one
+func pcapRecordNTP(conn net.Conn, remote net.Addr, outgoing bool, payload []byte, ts time.Time, note string) {
+	if pcapCapture == nil || len(payload) == 0 {
+		return
+	}
+	remoteUDP, ok := remote.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	direction := "request to"
+	if !outgoing {
+		direction = "response from"
+	}
+	protocol := fmt.Sprintf("NTPv%d", (payload[0]>>3)&0x7)
+	if (payload[0]>>3)&0x7 == 0 {
+		protocol = "NTP" // NTPv1 (RFC 1059) packets built by this tool have no version number
+	}
+	comment := fmt.Sprintf("measurement %s: %s %s %s", measurementID, protocol, direction, remoteUDP)
+	if note != "" {
+		comment += " (" + note + ")"
+	}
+	pcapCapture.writeUDP(pcapLocalUDPAddr(conn.LocalAddr(), remoteUDP), remoteUDP, outgoing, payload, ts, comment)
+}
+
+// keCaptureConn records the TCP stream of an NTS-KE connection. The segments are kept in memory and written when the
+// connection is closed, the last one with the decoded NTS-KE records as comment (the TLS secrets are not written).
+type keCaptureConn struct {
+	net.Conn
+	local, remote *net.TCPAddr
+	clientSeq     uint32
+	serverSeq     uint32
+	segments      []keSegment
+	keyLog        []byte
+	closed        bool
+}
+
+type keSegment struct {
+	outgoing bool
+	seq, ack uint32
+	flags    byte
+	payload  []byte
+	ts       time.Time
+}
+
+func newKECaptureConn(conn net.Conn) *keCaptureConn {
+	c := &keCaptureConn{Conn: conn, clientSeq: 1000, serverSeq: 5000}
+	c.local, _ = conn.LocalAddr().(*net.TCPAddr)
+	c.remote, _ = conn.RemoteAddr().(*net.TCPAddr)
+	// the TCP handshake already happened, we only write an equivalent one
+	now := time.Now()
+	c.add(true, TCP_FLAG_SYN, nil, now)
+	c.clientSeq++
+	c.add(false, TCP_FLAG_SYN|TCP_FLAG_ACK, nil, now)
+	c.serverSeq++
+	c.add(true, TCP_FLAG_ACK, nil, now)
+	return c
+}
+
+func (c *keCaptureConn) add(outgoing bool, flags byte, payload []byte, ts time.Time) {
+	seq, ack := c.clientSeq, c.serverSeq
+	if !outgoing {
+		seq, ack = c.serverSeq, c.clientSeq
+	}
+	if flags&TCP_FLAG_SYN != 0 && outgoing {
+		ack = 0
+	}
+	c.segments = append(c.segments, keSegment{outgoing, seq, ack, flags, append([]byte(nil), payload...), ts})
+}
+
+func (c *keCaptureConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.add(true, TCP_FLAG_PSH|TCP_FLAG_ACK, b[:n], time.Now())
+		c.clientSeq += uint32(n)
+	}
+	return n, err
+}
+
+func (c *keCaptureConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.add(false, TCP_FLAG_PSH|TCP_FLAG_ACK, b[:n], time.Now())
+		c.serverSeq += uint32(n)
+	}
+	return n, err
+}
+
+// keyLogBuffer receives the TLS secrets of the connection (it is the KeyLogWriter of the TLS config). They are only
+// kept in memory, to decrypt the NTS-KE records
+type keyLogBuffer struct {
+	c *keCaptureConn
+}
+
+func (k *keyLogBuffer) Write(line []byte) (int, error) {
+	k.c.keyLog = append(k.c.keyLog, line...)
+	return len(line), nil
+}
+
+func (c *keCaptureConn) Close() error {
+	err := c.Conn.Close()
+	if c.closed || pcapCapture == nil || c.local == nil || c.remote == nil {
+		return err
+	}
+	c.closed = true
+	now := time.Now()
+	c.add(true, TCP_FLAG_FIN|TCP_FLAG_ACK, nil, now)
+	c.clientSeq++
+	c.add(false, TCP_FLAG_FIN|TCP_FLAG_ACK, nil, now)
+	c.serverSeq++
+	c.add(true, TCP_FLAG_ACK, nil, now)
+
+	comment := fmt.Sprintf("measurement %s: NTS-KE with %s", measurementID, c.remote)
+	for i, s := range c.segments {
+		segmentComment := comment
+		if i == len(c.segments)-1 {
+			segmentComment += "; " + c.describeRecords()
+		}
+		pcapCapture.writeTCP(c.local, c.remote, s.outgoing, s.seq, s.ack, s.flags, s.payload, s.ts, segmentComment)
+	}
+	return err
+}
+
+// TLS 1.3 record decryption of the NTS-KE connection (RFC 8446, sections 5.2 and 7), with the secrets of the key log
+const (
+	TLS_RECORD_HANDSHAKE        = 22
+	TLS_RECORD_APPLICATION_DATA = 23
+	TLS_AES_128_GCM_SHA256      = 0x1301
+	TLS_AES_256_GCM_SHA384      = 0x1302
+)
+
+// describeRecords decrypts both directions of the connection and describes the NTS-KE records
+func (c *keCaptureConn) describeRecords() string {
+	var clientStream, serverStream []byte
+	for _, s := range c.segments {
+		if s.outgoing {
+			clientStream = append(clientStream, s.payload...)
+		} else {
+			serverStream = append(serverStream, s.payload...)
+		}
+	}
+	suite, ok := tlsServerHelloSuite(serverStream)
+	if !ok {
+		return "NTS-KE records not decoded (no TLS ServerHello)"
+	}
+	secrets := parseKeyLog(c.keyLog)
+	request, err := tlsApplicationData(clientStream, suite, secrets["CLIENT_HANDSHAKE_TRAFFIC_SECRET"], secrets["CLIENT_TRAFFIC_SECRET_0"])
+	if err != nil {
+		return fmt.Sprintf("NTS-KE records not decoded (%v)", err)
+	}
+	response, err := tlsApplicationData(serverStream, suite, secrets["SERVER_HANDSHAKE_TRAFFIC_SECRET"], secrets["SERVER_TRAFFIC_SECRET_0"])
+	if err != nil {
+		return fmt.Sprintf("NTS-KE records not decoded (%v)", err)
+	}
+	return fmt.Sprintf("NTS-KE request: %s; NTS-KE response: %s", strings.Join(describeNTSKERecords(request), ", "),
+		strings.Join(describeNTSKERecords(response), ", "))
+}
+
+// parseKeyLog reads the secrets of an NSS key log (one connection: "<label> <client random> <secret>")
+func parseKeyLog(keyLog []byte) map[string][]byte {
+	secrets := map[string][]byte{}
+	for _, line := range strings.Split(string(keyLog), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		if secret, err := hex.DecodeString(fields[2]); err == nil {
+			secrets[fields[0]] = secret
+		}
+	}
+	return secrets
+}
+
+// tlsRecords splits a TLS stream in records (type and the whole record, header included)
+func tlsRecords(stream []byte) [][]byte {
+	records := [][]byte{}
+	for len(stream) >= 5 {
+		length := 5 + int(binary.BigEndian.Uint16(stream[3:5]))
+		if length > len(stream) {
+			break
+		}
+		records = append(records, stream[:length])
+		stream = stream[length:]
+	}
+	return records
+}
+
+// tlsServerHelloSuite returns the cipher suite chosen in the ServerHello (first record of the server)
+func tlsServerHelloSuite(stream []byte) (uint16, bool) {
+	for _, record := range tlsRecords(stream) {
+		if record[0] != TLS_RECORD_HANDSHAKE {
+			continue
+		}
+		// handshake type (1), length (3), version (2), random (32), session id, cipher suite (2)
+		hello := record[5:]
+		if len(hello) < 39 || hello[0] != 2 {
+			return 0, false
+		}
+		offset := 39 + int(hello[38])
+		if len(hello) < offset+2 {
+			return 0, false
+		}
+		return binary.BigEndian.Uint16(hello[offset:]), true
+	}
+	return 0, false
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label of TLS 1.3 with an empty context
+func hkdfExpandLabel(newHash func() hash.Hash, secret []byte, label string, length int) []byte {
+	info := []byte{byte(length >> 8), byte(length), byte(len("tls13 " + label))}
+	info = append(info, "tls13 "+label...)
+	info = append(info, 0)
+	var out, t []byte
+	for i := byte(1); len(out) < length; i++ {
+		mac := hmac.New(newHash, secret)
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:length]
+}
+
+// tlsDecrypter opens the records protected with one traffic secret
+type tlsDecrypter struct {
+	aead cipher.AEAD
+	iv   []byte
+	seq  uint64
+}
+
+func newTLSDecrypter(suite uint16, secret []byte) (*tlsDecrypter, error) {
+	var newHash func() hash.Hash
+	var keySize int
+	switch suite {
+	case TLS_AES_128_GCM_SHA256:
+		newHash, keySize = sha256.New, 16
+	case TLS_AES_256_GCM_SHA384:
+		newHash, keySize = sha512.New384, 32
+	default:
+		return nil, fmt.Errorf("cipher suite 0x%04x is not supported", suite)
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("TLS secrets missing")
+	}
+	block, err := aes.NewCipher(hkdfExpandLabel(newHash, secret, "key", keySize))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &tlsDecrypter{aead: aead, iv: hkdfExpandLabel(newHash, secret, "iv", aead.NonceSize())}, nil
+}
+
+// open decrypts a record and returns its content and real content type
+func (d *tlsDecrypter) open(record []byte) ([]byte, byte, bool) {
+	nonce := append([]byte{}, d.iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(d.seq >> (8 * i))
+	}
+	plaintext, err := d.aead.Open(nil, nonce, record[5:], record[:5])
+	if err != nil {
+		return nil, 0, false
+	}
+	d.seq++
+	// the content is followed by the content type and padding zeros
+	end := len(plaintext) - 1
+	for end >= 0 && plaintext[end] == 0 {
+		end--
+	}
+	if end < 0 {
+		return nil, 0, false
+	}
+	return plaintext[:end], plaintext[end], true
+}
+
+// tlsApplicationData decrypts one direction of a TLS 1.3 connection and returns the application data. The first
+// encrypted records use the handshake secret, the next ones the application secret
+func tlsApplicationData(stream []byte, suite uint16, handshakeSecret []byte, trafficSecret []byte) ([]byte, error) {
+	handshake, err := newTLSDecrypter(suite, handshakeSecret)
+	if err != nil {
+		return nil, err
+	}
+	traffic, err := newTLSDecrypter(suite, trafficSecret)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	handshakeDone := false
+	for _, record := range tlsRecords(stream) {
+		if record[0] != TLS_RECORD_APPLICATION_DATA {
+			continue // ClientHello, ServerHello, ChangeCipherSpec
+		}
+		if !handshakeDone {
+			if _, _, ok := handshake.open(record); ok {
+				continue
+			}
+			handshakeDone = true
+		}
+		content, contentType, ok := traffic.open(record)
+		if !ok {
+			return data, fmt.Errorf("a TLS record could not be decrypted")
+		}
+		if contentType == TLS_RECORD_APPLICATION_DATA {
+			data = append(data, content...)
+		}
+	}
+	return data, nil
+}
+
+// ntsKEDial opens the TLS connection to an NTS-KE server (the Dialer of the NTS session). If the NTS-KE traffic is
+// exported to the pcap file, the TCP stream is recorded and the TLS secrets are kept in memory to decode the records.
+func ntsKEDial(dialer *net.Dialer, network string, addr string, tlsConfig *tls.Config) (*tls.Conn, error) {
+	if pcapCapture == nil || !pcapCapture.includeKE {
+		return tls.DialWithDialer(dialer, network, addr, tlsConfig)
+	}
+	conn, err := dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	capture := newKECaptureConn(conn)
+	config := tlsConfig.Clone()
+	if config.ServerName == "" {
+		// as tls.DialWithDialer does
+		host, _, _ := net.SplitHostPort(addr)
+		config.ServerName = host
+	}
+	config.KeyLogWriter = &keyLogBuffer{capture}
+	tlsConn := tls.Client(capture, config)
+	if dialer.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(dialer.Timeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		_ = capture.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
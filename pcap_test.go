@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// traffic keys of the "Simple 1-RTT Handshake" of RFC 8448 (section 3, TLS_AES_128_GCM_SHA256)
+func TestHKDFExpandLabelRFC8448(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		key    string
+		iv     string
+	}{
+		{
+			"server handshake",
+			"b6 7b 7d 69 0c c1 6c 4e 75 e5 42 13 cb 2d 37 b4 e9 c9 12 bc de d9 10 5d 42 be fd 59 d3 91 ad 38",
+			"3f ce 51 60 09 c2 17 27 d0 f2 e4 e8 6e e4 03 bc",
+			"5d 31 3e b2 67 12 76 ee 13 00 0b 30",
+		},
+		{
+			"client handshake",
+			"b3 ed db 12 6e 06 7f 35 a7 80 b3 ab f4 5e 2d 8f 3b 1a 95 07 38 f5 2e 96 00 74 6a 0e 27 a5 5a 21",
+			"db fa a6 93 d1 76 2c 5b 66 6a f5 d9 50 25 8d 01",
+			"5b d3 c7 1b 83 6e 0b 76 bb 73 26 5f",
+		},
+		{
+			"server application",
+			"a1 1a f9 f0 55 31 f8 56 ad 47 11 6b 45 a9 50 32 82 04 b4 f4 4b fb 6b 3a 4b 4f 1f 3f cb 63 16 43",
+			"9f 02 28 3b 6c 9c 07 ef c2 6b b9 f2 ac 92 e3 56",
+			"cf 78 2b 88 dd 83 54 9a ad f1 e9 84",
+		},
+	}
+	for _, tt := range tests {
+		secret := mustHex(t, tt.secret)
+		if key := hkdfExpandLabel(sha256.New, secret, "key", 16); !bytes.Equal(key, mustHex(t, tt.key)) {
+			t.Errorf("%s: key %x, want %s", tt.name, key, tt.key)
+		}
+		if iv := hkdfExpandLabel(sha256.New, secret, "iv", 12); !bytes.Equal(iv, mustHex(t, tt.iv)) {
+			t.Errorf("%s: iv %x, want %s", tt.name, iv, tt.iv)
+		}
+	}
+}
+
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "nts.test"},
+		DNSNames:     []string{"nts.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// a real TLS 1.3 connection (crypto/tls on both sides) recorded by keCaptureConn: the NTS-KE records must be decoded
+// from the captured stream with the secrets of the key log
+func TestDescribeRecordsTLS13(t *testing.T) {
+	var request, response bytes.Buffer
+	appendNTSKERecord(&request, NTSKE_CRITICAL|NTSKE_REC_NEXT_PROTOCOL, []byte{0, NTSKE_PROTOCOL_NTPV4})
+	appendNTSKERecord(&request, NTSKE_REC_AEAD, []byte{0, 15})
+	appendNTSKERecord(&request, NTSKE_CRITICAL|NTSKE_REC_EOM, nil)
+	appendNTSKERecord(&response, NTSKE_CRITICAL|NTSKE_REC_NEXT_PROTOCOL, []byte{0, NTSKE_PROTOCOL_NTPV4})
+	appendNTSKERecord(&response, NTSKE_REC_AEAD, []byte{0, 15})
+	appendNTSKERecord(&response, NTSKE_REC_SERVER, []byte("ntp.test"))
+	appendNTSKERecord(&response, NTSKE_REC_PORT, []byte{0, 123})
+	appendNTSKERecord(&response, NTSKE_REC_COOKIE, make([]byte, 100))
+	appendNTSKERecord(&response, NTSKE_REC_COOKIE, make([]byte, 100))
+	appendNTSKERecord(&response, NTSKE_CRITICAL|NTSKE_REC_EOM, nil)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	serverErr := make(chan error, 1)
+	go func() {
+		server := tls.Server(serverConn, &tls.Config{
+			Certificates:           []tls.Certificate{testCertificate(t)},
+			MinVersion:             tls.VersionTLS13,
+			NextProtos:             []string{NTSKE_ALPN},
+			SessionTicketsDisabled: true, // net.Pipe is synchronous, a ticket nobody reads would block the server
+		})
+		defer server.Close()
+		received := make([]byte, request.Len())
+		if _, err := io.ReadFull(server, received); err != nil {
+			serverErr <- err
+			return
+		}
+		_, err := server.Write(response.Bytes())
+		serverErr <- err
+	}()
+
+	capture := newKECaptureConn(clientConn)
+	client := tls.Client(capture, &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS13,
+		NextProtos:         []string{NTSKE_ALPN},
+		KeyLogWriter:       &keyLogBuffer{capture},
+	})
+	if _, err := client.Write(request.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(client, make([]byte, response.Len())); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatal(err)
+	}
+
+	description := capture.describeRecords()
+	want := "NTS-KE request: next protocol: NTPv4, AEAD: AEAD_AES_SIV_CMAC_256, end of message; " +
+		"NTS-KE response: next protocol: NTPv4, AEAD: AEAD_AES_SIV_CMAC_256, NTPv4 server: ntp.test, " +
+		"NTPv4 port: 123, end of message, 2 cookies (bytes: 100, 100)"
+	if description != want {
+		t.Errorf("describeRecords() = %q, want %q", description, want)
+	}
+
+	// without the secrets nothing is decoded
+	capture.keyLog = nil
+	if description := capture.describeRecords(); description != "NTS-KE records not decoded (TLS secrets missing)" {
+		t.Errorf("describeRecords() without secrets = %q", description)
+	}
+	if description := (&keCaptureConn{}).describeRecords(); description != "NTS-KE records not decoded (no TLS ServerHello)" {
+		t.Errorf("describeRecords() without a connection = %q", description)
+	}
+}
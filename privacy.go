@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"net"
+)
+
+// Privacy mode (client data minimization, see RFC 9109 and draft-ietf-ntp-data-minimization). A normal request has
+// the local time in the transmit timestamp, which tells everyone on the path (and the server) the state of our clock,
+// and is sent from the port chosen by the OS. In privacy mode:
+//   - the transmit timestamp is a random number, and the response is accepted only if its origin timestamp is that
+//     number (so an off-path attacker must guess 64 bits). t1 is kept only in ntpExchange.T1.
+//   - all the other client fields (leap, stratum, poll, precision, root delay and dispersion, reference ID and
+//     timestamp) are 0. Origin and receive stay as they are, they are 0 except in interleaved requests, where they
+//     are timestamps of the server.
+//   - every socket is bound to a fresh random source port (interleaved modes keep one socket for the whole series,
+//     as the server keeps the interleaved state for the client address).
+// NTPv5 requests carry no client timestamp (the client cookie is already random), so only the port changes for them.
+
+const PRIVACY_PORT_MIN = 1024 // random source ports are taken from 1024-65535
+
+// privacyRandomUint64 returns a random number from crypto/rand (math/rand is predictable)
+func privacyRandomUint64() uint64 {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return binary.BigEndian.Uint64(b)
+}
+
+// minimizeRequest returns a copy of an NTPv1-v4 request with a random transmit timestamp and all the other client
+// fields set to 0. NTPv5 requests are returned unchanged.
+func minimizeRequest(req []byte) []byte {
+	if len(req) < NTP_PACKET_SIZE || (req[0]>>3)&0x7 == NTPV5_VERSION {
+		return req
+	}
+	minimized := make([]byte, len(req))
+	copy(minimized, req)
+	minimized[0] = req[0] & 0x3f // LI = 0, keep version and mode
+	for i := 1; i < 24; i++ {
+		minimized[i] = 0 // stratum, poll, precision, root delay, root dispersion, reference ID and timestamp
+	}
+	tx := privacyRandomUint64()
+	for tx == 0 {
+		tx = privacyRandomUint64() // 0 would mean "no transmit timestamp"
+	}
+	binary.BigEndian.PutUint64(minimized[40:48], tx)
+	return minimized
+}
+
+// dialRandomPort opens the socket of a measurement bound to a random source port (a few ports are tried, in case
+// one is in use)
+func dialRandomPort(network string, remote *net.UDPAddr, unconnected bool) (net.Conn, error) {
+	var err error
+	for attempt := 0; attempt < 16; attempt++ {
+		n, rErr := rand.Int(rand.Reader, big.NewInt(65536-PRIVACY_PORT_MIN))
+		if rErr != nil {
+			return nil, rErr
+		}
+		local := &net.UDPAddr{Port: PRIVACY_PORT_MIN + int(n.Int64())}
+		var conn *net.UDPConn
+		if unconnected {
+			conn, err = net.ListenUDP(network, local)
+			if err == nil {
+				return &unconnectedUDPConn{UDPConn: conn, remote: remote}, nil
+			}
+		} else {
+			conn, err = net.DialUDP(network, local, remote)
+			if err == nil {
+				return conn, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("could not bind a random source port: %v", err)
+}
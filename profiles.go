@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Client emulation profiles. Servers (and middleboxes) can answer differently depending on fields that real clients
+// fill in, while our normal requests are almost all zeros. A profile is a craft template reproducing the first request
+// of a common client in its default configuration, before it is synchronized. The values are the typical ones seen in
+// captures of these clients (precision and poll depend on the machine and configuration).
+type clientProfile struct {
+	description string
+	template    string // craft template (JSON)
+}
+
+var clientProfiles = map[string]clientProfile{
+	"ntpd": {
+		description: "ntpd 4.2.8 (reference implementation): leap 3 until synchronized, poll 6, precision of the system clock, transmit timestamp is the real time",
+		template:    `{"version":4,"leap":3,"mode":3,"stratum":0,"poll":6,"precision":-23,"root_delay":0,"root_disp":0,"tx_timestamp":"now"}`,
+	},
+	"chrony": {
+		description: "chrony 4.x: leap 3 until synchronized, poll 6, random transmit timestamp (it does not reveal its clock), origin and receive 0",
+		template:    `{"version":4,"leap":3,"mode":3,"stratum":0,"poll":6,"precision":-25,"root_delay":0,"root_disp":0,"tx_timestamp":"random"}`,
+	},
+	"systemd-timesyncd": {
+		description: "systemd-timesyncd (SNTP client): everything 0 except version, mode and the real transmit timestamp",
+		template:    `{"version":4,"leap":0,"mode":3,"stratum":0,"poll":0,"precision":0,"tx_timestamp":"now"}`,
+	},
+	"sntp": {
+		description: "minimal SNTP client (RFC 4330), like busybox or embedded devices: NTPv3 header with only the transmit timestamp",
+		template:    `{"version":3,"leap":0,"mode":3,"stratum":0,"poll":0,"precision":0,"tx_timestamp":"now"}`,
+	},
+	"windows": {
+		description: "Windows Time service (w32time): NTPv3, leap 3 until synchronized, poll 10, root dispersion of its local clock",
+		template:    `{"version":3,"leap":3,"mode":3,"stratum":0,"poll":10,"precision":-23,"root_delay":0,"root_disp":10,"tx_timestamp":"now"}`,
+	},
+	"ntpv5-padded": {
+		description: "NTPv5 client (like chrony with NTPv5 enabled) that pads its request with a Padding extension field, so the response is not bigger than the request",
+		template:    `{"version":5,"leap":3,"mode":3,"stratum":0,"poll":6,"precision":-25,"extensions":[{"type":62721,"data":"000000000000000000000000000000000000000000000000"}]}`,
+	},
+}
+
+func clientProfileNames() []string {
+	names := []string{}
+	for name := range clientProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// performClientProfilesMeasurement sends the request of every client profile (one after the other) and shows how
+// the server answered each of them. It fails only if the server did not answer any profile.
+func performClientProfilesMeasurement(server string, timeout float64, draft string, opts MeasurementOptions) (map[string]interface{}, string, int) {
+	var output strings.Builder
+	error_message := map[string]interface{}{}
+	profiles := map[string]interface{}{}
+	answered := []string{}
+	lastCode := 0
+	for i, name := range clientProfileNames() {
+		if i > 0 {
+			time.Sleep(300 * time.Millisecond) // do not spam the server
+		}
+		output.WriteString(fmt.Sprintf("profile %s\n", name))
+		template, err := parseCraftTemplate(name, "", "")
+		if err != nil {
+			output.WriteString(fmt.Sprintf("%v\n", err))
+			continue
+		}
+		result, debug, code := performCraftedMeasurement(server, timeout, draft, template, opts)
+		output.WriteString(debug)
+		info := map[string]interface{}{
+			"description": clientProfiles[name].description,
+			"answered":    code == 0,
+			"code":        code,
+		}
+		if code == 0 {
+			info["result"] = result
+			answered = append(answered, name)
+		} else {
+			info["error"] = result["error"]
+			lastCode = code
+		}
+		profiles[name] = info
+	}
+	if len(answered) == 0 {
+		m := "the server did not answer any client profile\n"
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), lastCode
+	}
+	return map[string]interface{}{
+		"Host":              server,
+		"profiles":          profiles,
+		"answered_profiles": answered,
+	}, output.String(), 0
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Capability scan ("scan" command): one report of what a server supports, made of the other measurements of this
+// tool. Every probe is sent once (the rate limiting probe sends a short burst), with a pause between the probes.
+// Mode 6 control queries are included, and with -mode7 the monlist request of mode7_audit, so scan only servers you
+// are allowed to audit.
+
+const (
+	SCAN_PAUSE          = 1000 * time.Millisecond // between two probes, as in allntpv
+	SCAN_BURST_REQUESTS = 10                      // requests of the rate limiting probe
+	SCAN_BURST_INTERVAL = 100 * time.Millisecond
+	SCAN_UNKNOWN_EXT    = 0xF5F0 // extension field type that no server should know
+	SCAN_SAMPLES        = 3      // requests of the interleaved probes
+)
+
+var scanDrafts = []string{"draft-ietf-ntp-ntpv5-05", "draft-ietf-ntp-ntpv5-06"}
+
+// kissCode returns the kiss code of a response with stratum 0 ("" for the other responses)
+func kissCode(result map[string]interface{}) string {
+	if result["stratum"] != uint8(0) {
+		return ""
+	}
+	refID, ok := result["ref_id"].(uint32)
+	if !ok {
+		return ""
+	}
+	code := make([]byte, 4)
+	binary.BigEndian.PutUint32(code, refID)
+	return strings.TrimRight(string(code), "\x00")
+}
+
+// scanExtensionEcho sends a request with an extension field of an unknown type and tells if the server answers,
+// and if it sends the field back
+func scanExtensionEcho(ip string, timeout float64, version int, draft string, opts MeasurementOptions) map[string]interface{} {
+	data := make([]byte, 12) // 16-byte field, the minimum of RFC 7822
+	_, _ = rand.Read(data)
+	template, err := parseCraftTemplate("", fmt.Sprintf(`{"version":%d,"extensions":[{"type":%d,"data":"%x"}]}`,
+		version, SCAN_UNKNOWN_EXT, data), "")
+	if err != nil {
+		return map[string]interface{}{"answered": false, "error": err.Error()}
+	}
+	result, _, code := performCraftedMeasurement(ip, timeout, draft, template, opts)
+	info := map[string]interface{}{"answered": code == 0, "return_code": code}
+	if code != 0 {
+		return info
+	}
+	echoed, ok := findExtensionField(result, SCAN_UNKNOWN_EXT)
+	info["echoed"] = ok && bytes.Equal(echoed, data)
+	info["response_version"] = result["version"]
+	info["request_bytes"] = result["request_bytes"]
+	info["response_bytes"] = result["response_bytes"]
+	if exts, ok := result["extensions"].([]map[string]interface{}); ok {
+		info["response_extensions"] = len(exts)
+	}
+	return info
+}
+
+// scanRateLimiting sends a short burst of NTPv4 requests and records which ones were answered and the kiss codes
+func scanRateLimiting(ip string, timeout float64, opts MeasurementOptions) map[string]interface{} {
+	answers := []interface{}{}
+	answered, kod, dropped := 0, 0, 0
+	firstLimited := -1
+	for i := 0; i < SCAN_BURST_REQUESTS; i++ {
+		if i > 0 {
+			time.Sleep(SCAN_BURST_INTERVAL)
+		}
+		result, _, code := performNTPv4Measurement(ip, timeout, opts)
+		answer := map[string]interface{}{"answered": code == 0}
+		if code == 0 {
+			answered++
+			if kiss := kissCode(result); kiss != "" {
+				answer["kiss_code"] = kiss
+				kod++
+				if firstLimited < 0 {
+					firstLimited = i
+				}
+			}
+		} else {
+			dropped++
+			if firstLimited < 0 && answered > 0 {
+				firstLimited = i
+			}
+		}
+		answers = append(answers, answer)
+	}
+	info := map[string]interface{}{
+		"requests":      SCAN_BURST_REQUESTS,
+		"interval":      SCAN_BURST_INTERVAL.Seconds(),
+		"answered":      answered,
+		"kiss_of_death": kod,
+		"dropped":       dropped,
+		"rate_limited":  firstLimited >= 0,
+		"answers":       answers,
+	}
+	if firstLimited >= 0 {
+		info["first_limited_request"] = firstLimited
+	}
+	return info
+}
+
+// resolveScanTarget returns the IPv4 and IPv6 addresses of a host (or the host itself if it is an IP address). The
+// UDP probes go to the first one, so that all of them measure the same server
+func resolveScanTarget(host string) ([]string, []string, error) {
+	ips := []net.IP{}
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append(ips, ip)
+	} else {
+		found, err := net.LookupIP(host)
+		if err != nil {
+			return nil, nil, err
+		}
+		ips = found
+	}
+	ipv4, ipv6 := []string{}, []string{}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			ipv4 = append(ipv4, ip.String())
+		} else {
+			ipv6 = append(ipv6, ip.String())
+		}
+	}
+	return ipv4, ipv6, nil
+}
+
+// performScan probes everything this tool can measure on one server and returns a capability profile. The UDP
+// probes go to one address of the host (IPv4 if it has one), NTS uses the host name (to check the certificate).
+// The mode 7 monlist request is sent only with withMode7 (it is an audit probe, not a capability check).
+func performScan(host string, timeout float64, withMode7 bool, opts MeasurementOptions) (map[string]interface{}, string, int) {
+	var output strings.Builder
+	error_message := map[string]interface{}{}
+
+	ipv4, ipv6, err := resolveScanTarget(host)
+	if err != nil {
+		m := fmt.Sprintf("could not resolve %s: %v\n", host, err)
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 1
+	}
+	scanned := ""
+	if len(ipv4) > 0 {
+		scanned = ipv4[0]
+	} else if len(ipv6) > 0 {
+		scanned = ipv6[0]
+	}
+	output.WriteString(fmt.Sprintf("scanning %s (%s)\n", host, scanned))
+	anyAnswer := false
+
+	// NTP versions (and the version number of the answers)
+	versions := map[string]interface{}{}
+	allVersions, _, _ := check_all_ntp_versions(scanned, timeout, "", false, "", SCAN_PAUSE, false, opts)
+	for _, name := range []string{"ntpv1", "ntpv2", "ntpv3", "ntpv4", "ntpv5"} {
+		info := allVersions[name].(map[string]interface{})
+		result := info["result"].(map[string]interface{})
+		v := map[string]interface{}{
+			"answered":    info["return_code"] == 0,
+			"return_code": info["return_code"],
+		}
+		if info["return_code"] == 0 {
+			anyAnswer = true
+			v["response_version"] = result["version"]
+			v["amplification_factor"] = result["amplification_factor"]
+			if kiss := kissCode(result); kiss != "" {
+				v["kiss_code"] = kiss
+			}
+		}
+		versions[name] = v
+	}
+	v5Answered := versions["ntpv5"].(map[string]interface{})["response_version"] == uint8(NTPV5_VERSION)
+
+	// NTPv5 drafts: the server must answer NTPv5 and send back our draft identification
+	drafts := map[string]interface{}{}
+	for _, draft := range scanDrafts {
+		time.Sleep(SCAN_PAUSE)
+		result, _, code := performNTPv5Measurement(scanned, timeout, draft, TIMESCALE_UTC, opts)
+		d := map[string]interface{}{"answered": code == 0, "supported": false}
+		if code == 0 {
+			anyAnswer = true
+			echo, ok := findExtensionField(result, NTPV5_EXT_DRAFT_ID)
+			echoed := ok && strings.TrimRight(string(echo), "\x00") == draft
+			d["response_version"] = result["version"]
+			d["client_cookie_valid"] = result["client_cookie_valid"]
+			d["draft_echoed"] = echoed
+			d["supported"] = result["version"] == uint8(NTPV5_VERSION) && result["client_cookie_valid"] == true && echoed
+		}
+		drafts[draft] = d
+	}
+
+	// interleaved mode
+	interleaved := map[string]interface{}{}
+	time.Sleep(SCAN_PAUSE)
+	if result, _, code := performNTPv4InterleavedMeasurement(scanned, timeout, SCAN_SAMPLES, opts); code == 0 {
+		interleaved["ntpv4"] = result["interleaved"].(map[string]interface{})["supported"]
+	} else {
+		interleaved["ntpv4"] = false
+	}
+	if v5Answered {
+		time.Sleep(SCAN_PAUSE)
+		if result, _, code := performNTPv5InterleavedMeasurement(scanned, timeout, "", SCAN_SAMPLES, opts); code == 0 {
+			interleaved["ntpv5"] = result["interleaved"].(map[string]interface{})["supported"]
+		} else {
+			interleaved["ntpv5"] = false
+		}
+	}
+
+	// unknown extension fields: ignored, echoed, or the request is dropped
+	extensions := map[string]interface{}{}
+	time.Sleep(SCAN_PAUSE)
+	extensions["ntpv4"] = scanExtensionEcho(scanned, timeout, 4, "", opts)
+	if v5Answered {
+		time.Sleep(SCAN_PAUSE)
+		extensions["ntpv5"] = scanExtensionEcho(scanned, timeout, 5, "", opts)
+	}
+
+	// symmetric keys: a key the server cannot know gives a crypto-NAK if it checks MACs
+	symmetric := map[string]interface{}{}
+	unknownKey := &ntpKey{ID: 65535, Type: AUTH_MD5, Key: make([]byte, 16)}
+	_, _ = rand.Read(unknownKey.Key)
+	keys := map[string]*ntpKey{"unknown_key": unknownKey}
+	if opts.Key != nil {
+		keys["configured_key"] = opts.Key
+	}
+	for _, name := range []string{"unknown_key", "configured_key"} {
+		if keys[name] == nil {
+			continue
+		}
+		time.Sleep(SCAN_PAUSE)
+		keyOpts := opts
+		keyOpts.Key = keys[name]
+		result, _, code := performNTPv4Measurement(scanned, timeout, keyOpts)
+		if code == 0 {
+			symmetric[name] = result["authentication"].(map[string]interface{})["status"]
+		} else {
+			symmetric[name] = "no_response"
+		}
+	}
+	symmetric["checks_macs"] = symmetric["unknown_key"] == AUTH_STATUS_CRYPTO_NAK
+	if status, ok := symmetric["configured_key"]; ok {
+		symmetric["authenticated"] = status == AUTH_STATUS_AUTHENTICATED
+	}
+
+	// mode 6 and mode 7 exposure
+	time.Sleep(SCAN_PAUSE)
+	mode6 := map[string]interface{}{"answers_control_queries": false}
+	if result, _, code := performMode6Measurement(scanned, timeout, opts); code == 0 {
+		mode6["rejected"] = result["rejected"]
+		mode6["amplification_factor"] = result["amplification_factor"]
+		if result["answers_control_queries"] == true {
+			disclosed := []string{}
+			for name := range result["disclosed"].(map[string]string) {
+				disclosed = append(disclosed, name)
+			}
+			sort.Strings(disclosed)
+			mode6["answers_control_queries"] = true
+			mode6["disclosed"] = disclosed
+		}
+	}
+	mode7 := map[string]interface{}{"probed": withMode7}
+	if withMode7 {
+		time.Sleep(SCAN_PAUSE)
+		if result, _, code := performMode7Audit(scanned, timeout, opts); code == 0 {
+			for _, key := range []string{"replies", "vulnerable", "response_bytes", "amplification_factor"} {
+				mode7[key] = result[key]
+			}
+		}
+	}
+
+	// rate limiting and kiss-o'-death
+	time.Sleep(SCAN_PAUSE)
+	rateLimiting := scanRateLimiting(scanned, timeout, opts)
+
+	// IPv4 and IPv6
+	families := map[string]interface{}{}
+	for _, family := range []struct {
+		name      string
+		addresses []string
+	}{{"ipv4", ipv4}, {"ipv6", ipv6}} {
+		f := map[string]interface{}{"addresses": family.addresses, "answered": false}
+		if len(family.addresses) > 0 {
+			time.Sleep(SCAN_PAUSE)
+			_, _, code := performNTPv4Measurement(family.addresses[0], timeout, opts)
+			f["answered"] = code == 0
+		}
+		families[family.name] = f
+	}
+
+	// NTS (the key exchange is on TCP, so it tells nothing about UDP: it does not count as an answer)
+	time.Sleep(SCAN_PAUSE)
+	ntsInfo := map[string]interface{}{"available": false}
+	ntsResult, _, ntsCode := performNTSMeasurement(host, "", timeout)
+	ntsInfo["return_code"] = ntsCode
+	if ntsSucceeded(ntsCode) {
+		ntsInfo["available"] = true
+		ntsInfo["measured_ip"] = ntsResult["Measured server IP"]
+		time.Sleep(SCAN_PAUSE)
+		ntsInfo["aead_algorithms"] = probeNTSAEADs(host, timeout, &output)
+	} else {
+		ntsInfo["error"] = strings.TrimSpace(fmt.Sprint(ntsResult["error"]))
+	}
+
+	if !anyAnswer && ntsInfo["available"] == false {
+		m := fmt.Sprintf("%s did not answer any NTP or NTS probe\n", host)
+		output.WriteString(m)
+		error_message["error"] = m
+		return error_message, output.String(), 3
+	}
+	return map[string]interface{}{
+		"Host":               host,
+		"Measured server IP": scanned,
+		"versions":           versions,
+		"ntpv5_drafts":       drafts,
+		"nts":                ntsInfo,
+		"interleaved":        interleaved,
+		"extension_fields":   extensions,
+		"symmetric_key":      symmetric,
+		"mode6":              mode6,
+		"mode7":              mode7,
+		"rate_limiting":      rateLimiting,
+		"ip_families":        families,
+	}, output.String(), 0
+}
@@ -0,0 +1,130 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Kernel timestamps (Linux). With SO_TIMESTAMPING the kernel tells us when the response was received (in the control
+// messages of the datagram) and when our request was sent (in the error queue of the socket). The software timestamps
+// are taken by the network stack, the hardware ones by the NIC (only if the NIC is already configured for it, e.g. by
+// ptp4l or chronyd). If SO_TIMESTAMPING is not available, we try SO_TIMESTAMPNS (only receive timestamps).
+
+const (
+	TS_SOURCE_USERSPACE       = "userspace"
+	TS_SOURCE_KERNEL_SOFTWARE = "kernel_software"
+	TS_SOURCE_KERNEL_HARDWARE = "kernel_hardware"
+)
+
+// enableKernelTimestamps asks the kernel for timestamps on this socket. It returns false if the socket will not
+// have them (then the caller uses userspace timestamps).
+func enableKernelTimestamps(conn *net.UDPConn, hardware bool) bool {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	flags := unix.SOF_TIMESTAMPING_SOFTWARE | unix.SOF_TIMESTAMPING_RX_SOFTWARE | unix.SOF_TIMESTAMPING_TX_SOFTWARE |
+		unix.SOF_TIMESTAMPING_OPT_TSONLY
+	if hardware {
+		flags |= unix.SOF_TIMESTAMPING_RAW_HARDWARE | unix.SOF_TIMESTAMPING_RX_HARDWARE | unix.SOF_TIMESTAMPING_TX_HARDWARE
+	}
+	enabled := false
+	_ = raw.Control(func(fd uintptr) {
+		if unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TIMESTAMPING, flags) == nil {
+			enabled = true
+		} else if unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1) == nil {
+			enabled = true
+		}
+	})
+	return enabled
+}
+
+// timestampFromControlMessages extracts the kernel timestamp from the control messages of a received datagram (or of
+// a message from the error queue). The hardware timestamp is preferred, if there is one.
+func timestampFromControlMessages(oob []byte) (time.Time, string, bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level != unix.SOL_SOCKET {
+			continue
+		}
+		if msg.Header.Type == unix.SCM_TIMESTAMPING && len(msg.Data) >= 3*int(unsafe.Sizeof(unix.Timespec{})) {
+			// 3 timespecs: software, deprecated, hardware
+			ts := (*[3]unix.Timespec)(unsafe.Pointer(&msg.Data[0]))
+			if ts[2].Sec != 0 || ts[2].Nsec != 0 {
+				return time.Unix(int64(ts[2].Sec), int64(ts[2].Nsec)), TS_SOURCE_KERNEL_HARDWARE, true
+			}
+			if ts[0].Sec != 0 || ts[0].Nsec != 0 {
+				return time.Unix(int64(ts[0].Sec), int64(ts[0].Nsec)), TS_SOURCE_KERNEL_SOFTWARE, true
+			}
+		}
+		if msg.Header.Type == unix.SCM_TIMESTAMPNS && len(msg.Data) >= int(unsafe.Sizeof(unix.Timespec{})) {
+			ts := (*unix.Timespec)(unsafe.Pointer(&msg.Data[0]))
+			return time.Unix(int64(ts.Sec), int64(ts.Nsec)), TS_SOURCE_KERNEL_SOFTWARE, true
+		}
+	}
+	return time.Time{}, "", false
+}
+
+// readErrorQueue returns the timestamps of all the messages waiting in the error queue of the socket
+func readErrorQueue(conn *net.UDPConn) []kernelTimestamp {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	buf := make([]byte, 512)
+	oob := make([]byte, 512)
+	found := []kernelTimestamp{}
+	for {
+		oobn, recvErr := 0, error(nil)
+		_ = raw.Control(func(fd uintptr) {
+			_, oobn, _, _, recvErr = unix.Recvmsg(int(fd), buf, oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+		})
+		if recvErr != nil {
+			return found
+		}
+		if t, source, ok := timestampFromControlMessages(oob[:oobn]); ok {
+			found = append(found, kernelTimestamp{t, source})
+		}
+	}
+}
+
+type kernelTimestamp struct {
+	time   time.Time
+	source string
+}
+
+// discardKernelTxTimestamps empties the error queue, so that old (late) timestamps are not taken for the next request
+func discardKernelTxTimestamps(conn *net.UDPConn) {
+	readErrorQueue(conn)
+}
+
+// kernelTxTimestamp reads the transmit timestamp of the last sent datagram from the error queue. It is called right
+// after sending: the software timestamp is there almost immediately, we only wait a few milliseconds for it (or for
+// the hardware one, which comes in a separate message).
+func kernelTxTimestamp(conn *net.UDPConn, hardware bool) (time.Time, string, bool) {
+	var best *kernelTimestamp
+	for attempt := 0; attempt < 10; attempt++ {
+		for _, ts := range readErrorQueue(conn) {
+			ts := ts
+			if best == nil || ts.source == TS_SOURCE_KERNEL_HARDWARE {
+				best = &ts
+			}
+		}
+		if best != nil && (!hardware || best.source == TS_SOURCE_KERNEL_HARDWARE || attempt >= 4) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if best == nil {
+		return time.Time{}, "", false
+	}
+	return best.time, best.source, true
+}
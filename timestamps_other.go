@@ -0,0 +1,30 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// Kernel timestamps are only implemented for Linux. On other systems we always use userspace timestamps.
+
+const (
+	TS_SOURCE_USERSPACE       = "userspace"
+	TS_SOURCE_KERNEL_SOFTWARE = "kernel_software"
+	TS_SOURCE_KERNEL_HARDWARE = "kernel_hardware"
+)
+
+func enableKernelTimestamps(conn *net.UDPConn, hardware bool) bool {
+	return false
+}
+
+func timestampFromControlMessages(oob []byte) (time.Time, string, bool) {
+	return time.Time{}, "", false
+}
+
+func discardKernelTxTimestamps(conn *net.UDPConn) {}
+
+func kernelTxTimestamp(conn *net.UDPConn, hardware bool) (time.Time, string, bool) {
+	return time.Time{}, "", false
+}
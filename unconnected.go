@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+)
+
+// With a connected UDP socket (net.Dial) the kernel drops every datagram that does not come from the address we sent
+// to, and we read only one datagram. So a reply from another address of a multi-homed server (or changed by anycast
+// or NAT) looks like a timeout, and duplicated or late replies are never seen. In unconnected mode we send with
+// WriteTo, keep reading until the deadline, record every datagram that arrives and then pick the valid reply.
+
+// unconnectedUDPConn is an unconnected UDP socket that remembers the server address, so that it can be used like a
+// connected one by the measurers (Write sends to the server, RemoteAddr returns it).
+type unconnectedUDPConn struct {
+	*net.UDPConn
+	remote *net.UDPAddr
+}
+
+func (c *unconnectedUDPConn) Write(b []byte) (int, error) {
+	return c.UDPConn.WriteToUDP(b, c.remote)
+}
+
+func (c *unconnectedUDPConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// dialNTP opens the UDP socket used for a measurement: a connected one, or an unconnected one if asked in opts.
+// In privacy mode the socket is bound to a random source port (see privacy.go).
+func dialNTP(addr string, timeout float64, opts MeasurementOptions) (net.Conn, error) {
+	if !opts.Unconnected && !opts.Privacy {
+		return net.DialTimeout("udp", addr, time.Duration(timeout*float64(time.Second)))
+	}
+	remote, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	network := "udp6"
+	if remote.IP.To4() != nil {
+		network = "udp4"
+	}
+	if opts.Privacy {
+		return dialRandomPort(network, remote, opts.Unconnected)
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &unconnectedUDPConn{UDPConn: conn, remote: remote}, nil
+}
+
+// responseMatchesRequest checks if a datagram is the answer to our request: the origin timestamp must be our transmit
+// timestamp (or, in NTPv4 interleaved mode, our receive timestamp). In NTPv5 the client cookie must be echoed.
+func responseMatchesRequest(req []byte, resp []byte) bool {
+	if len(req) < 48 || len(resp) < 48 {
+		return false
+	}
+	if (req[0]>>3)&0x7 == NTPV5_VERSION {
+		return bytes.Equal(resp[24:32], req[24:32])
+	}
+	if bytes.Equal(resp[24:32], req[40:48]) {
+		return true
+	}
+	return binary.BigEndian.Uint64(req[32:40]) != 0 && bytes.Equal(resp[24:32], req[32:40])
+}
+
+// sameUDPSource compares the IP and port of two addresses (an IPv4 address can come back as an IPv4-mapped one)
+func sameUDPSource(a *net.UDPAddr, b *net.UDPAddr) bool {
+	return a != nil && b != nil && a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+// receiveUnconnected reads all the datagrams arriving until the deadline. The chosen response is the first valid one
+// from the server address, or else the first valid one from any address (then SourceMismatch is set). The other valid
+// replies and the repeated datagrams are flagged as duplicates.
+func receiveUnconnected(conn *unconnectedUDPConn, req []byte, ex *ntpExchange, kernel bool) error {
+	chosen := -1
+	var received [][]byte
+	for {
+		resp := make([]byte, 1024)
+		oob := make([]byte, 512)
+		n, oobn, _, from, err := conn.ReadMsgUDP(resp, oob)
+		arrivedAt := time.Now()
+		arrival := nowToNtpUint64()
+		arrivalSource := TS_SOURCE_USERSPACE
+		if err != nil {
+			break // deadline reached (or the socket failed)
+		}
+		if kernel {
+			if t, source, ok := timestampFromControlMessages(oob[:oobn]); ok {
+				arrivedAt = t
+				arrival, arrivalSource = timeToNtpUint64(t.Add(simulatedClockShift)), source
+			}
+		}
+		resp = resp[:n]
+		ex.ReceivedBytes += n
+		ex.ReceivedDatagrams++
+		valid := responseMatchesRequest(req, resp)
+		fromServer := sameUDPSource(from, conn.remote)
+		datagram := map[string]interface{}{
+			"source":         from.String(),
+			"arrival_time":   arrival,
+			"size":           n,
+			"raw":            hex.EncodeToString(resp),
+			"source_matches": fromServer,
+			"valid_response": valid,
+			"duplicate":      false,
+			"chosen":         false,
+		}
+		if valid && (chosen == -1 || (fromServer && !ex.Datagrams[chosen]["source_matches"].(bool))) {
+			if chosen != -1 {
+				// a reply from the server address is better than the one from another address
+				ex.Datagrams[chosen]["chosen"] = false
+				ex.Datagrams[chosen]["duplicate"] = true
+			}
+			chosen = len(ex.Datagrams)
+			datagram["chosen"] = true
+			ex.Response, ex.T4, ex.T4Source = resp, arrival, arrivalSource
+			ex.SourceMismatch = !fromServer
+			ex.ResponseSource = from.String()
+		} else if valid {
+			datagram["duplicate"] = true
+		} else {
+			for _, r := range received {
+				if bytes.Equal(r, resp) {
+					datagram["duplicate"] = true
+				}
+			}
+		}
+		received = append(received, resp)
+		note := ""
+		if !valid {
+			note = "not a response to our request"
+		} else if datagram["duplicate"] == true {
+			note = "duplicate"
+		}
+		pcapRecordNTP(conn, from, false, resp, arrivedAt, note)
+		ex.Datagrams = append(ex.Datagrams, datagram)
+	}
+	for _, d := range ex.Datagrams {
+		if d["duplicate"] == true {
+			ex.Duplicates++
+		}
+	}
+	if chosen == -1 {
+		return fmt.Errorf("measurement timeout: no valid response received (%d datagrams received)", len(ex.Datagrams))
+	}
+	return nil
+}
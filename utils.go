@@ -1,8 +1,11 @@
 package main
 
 import (
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net"
 	"strings"
 	"time"
 )
@@ -13,39 +16,172 @@ func time32ToSeconds(val uint32) float64 {
 	return float64(intPart) + float64(fracPart)/65536.0
 }
 
+// simulatedClockShift is added to our clock (see -simulate-time). It is always 0, except when we test how the
+// parsers behave in another NTP era (for example after the 2036 rollover).
+var simulatedClockShift time.Duration
+
+// localNow is the time of our clock (time.Now, plus the simulated shift if any)
+func localNow() time.Time {
+	return time.Now().Add(simulatedClockShift)
+}
+
+// NTP timestamps only have 32 bits for seconds, so they wrap every 2^32 seconds (~136 years). Each such period is an
+// era: era 0 started on 1900-01-01, era 1 starts on 2036-02-07 06:28:16 UTC. The timestamps do not contain the era,
+// so we take the era in which the timestamp is the closest to our clock (this works if the timestamp is within ~68
+// years from our clock). NTPv5 sends the era in the header, so there we use ntp64ToTimeInEra directly.
+const ntpEraSeconds = 1 << 32
+
 func ntp64ToTime(ntp uint64) time.Time {
-	// NTP epoch starts 1900, Unix starts 1970 -> difference is 2208988800s
-	const ntpEpochOffset = 2208988800
-	secs := int64(ntp >> 32)
-	frac := float64(ntp&0xFFFFFFFF) / (1 << 32)
-	return time.Unix(secs-int64(ntpEpochOffset), int64(frac*1e9))
+	return ntp64ToTimeInEra(ntp, ntpEraNear(ntp, localNow()))
 }
+
+// timeToNtpUint64 works in any era: the seconds that do not fit in 32 bits (the era) are dropped by the shift
 func timeToNtpUint64(t time.Time) uint64 {
+	// NTP epoch starts 1900, Unix starts 1970 -> difference is 2208988800s
 	const ntpEpochOffset = 2208988800
 	secs := uint64(t.Unix() + ntpEpochOffset)
 	frac := uint64((float64(t.Nanosecond()) / 1e9) * (1 << 32))
 	return (secs << 32) | frac
 }
 func nowToNtpUint64() uint64 {
-	t := time.Now()
-	unixSec := t.Unix() // seconds since 1970-01-01
-	unixNano := t.Nanosecond()
-	ntpSec := uint64(unixSec + 2208988800)
-	frac := uint64((float64(unixNano) / 1e9) * (1 << 32))
-	return (ntpSec << 32) | frac
+	return timeToNtpUint64(localNow())
 }
+
+// ntp64ToFloatSeconds returns the seconds since 1900-01-01 (era 0) of a timestamp, using the era closest to our clock
 func ntp64ToFloatSeconds(ntp uint64) float64 {
-	seconds := float64(ntp >> 32)                  // integer part
-	frac := float64(ntp&0xFFFFFFFF) / 4294967296.0 // fractional part
+	return ntp64ToFloatSecondsInEra(ntp, ntpEraNear(ntp, localNow()))
+}
+
+// ntpEraNear returns the era in which the timestamp is the closest to the pivot
+func ntpEraNear(ntp uint64, pivot time.Time) int {
+	const ntpEpochOffset = 2208988800
+	pivotSecs := pivot.Unix() + ntpEpochOffset
+	era := ntpEraOf(pivot)
+	secs := int64(era)*ntpEraSeconds + int64(ntp>>32)
+	if secs-pivotSecs > ntpEraSeconds/2 {
+		era--
+	} else if pivotSecs-secs > ntpEraSeconds/2 {
+		era++
+	}
+	return era
+}
+
+// ntpEraOf returns the NTP era of a time
+func ntpEraOf(t time.Time) int {
+	const ntpEpochOffset = 2208988800
+	secs := t.Unix() + ntpEpochOffset // seconds since 1900
+	era := secs / ntpEraSeconds
+	if secs < 0 && secs%ntpEraSeconds != 0 {
+		era-- // floor division for dates before 1900
+	}
+	return int(era)
+}
+
+// ntp64ToFloatSecondsInEra is ntp64ToFloatSeconds for a timestamp from the given era (the result is in seconds since
+// 1900-01-01, so it can be bigger than 2^32)
+func ntp64ToFloatSecondsInEra(ntp uint64, era int) float64 {
+	seconds := float64(int64(era)*ntpEraSeconds + int64(ntp>>32)) // integer part
+	frac := float64(ntp&0xFFFFFFFF) / 4294967296.0                // fractional part
 	return seconds + frac
 }
+
+// ntp64ToTimeInEra is ntp64ToTime for a timestamp from the given era
+func ntp64ToTimeInEra(ntp uint64, era int) time.Time {
+	const ntpEpochOffset = 2208988800
+	secs := int64(ntp>>32) + int64(era)*ntpEraSeconds - ntpEpochOffset
+	nanos := int64((ntp & 0xFFFFFFFF) * 1e9 >> 32)
+	return time.Unix(secs, nanos)
+}
+
+// ntpEraName describes the period of an era, like "era 0 (1900-01-01 to 2036-02-07)"
+func ntpEraName(era int) string {
+	start := ntp64ToTimeInEra(0, era).UTC()
+	end := ntp64ToTimeInEra(0, era+1).UTC()
+	return fmt.Sprintf("era %d (%s to %s)", era, start.Format("2006-01-02"), end.Format("2006-01-02"))
+}
+
+// ntpTimestampDiff returns a - b as a signed 32.32 fixed-point number (units of 2^-32 s). The subtraction is done on
+// the integer timestamps, so nothing is lost (float64 seconds since 1900 only resolve ~0.5 microseconds), and it also
+// works across an era rollover as long as the two timestamps are less than ~68 years apart.
+func ntpTimestampDiff(a uint64, b uint64) int64 {
+	return int64(a - b)
+}
+
+// ntpFixedToNanoseconds converts a signed 32.32 fixed-point duration to nanoseconds (rounded)
+func ntpFixedToNanoseconds(d int64) int64 {
+	secs := d >> 32                // floor, also for negative values
+	frac := uint64(d & 0xFFFFFFFF) // always positive
+	return secs*1e9 + int64((frac*1e9+(1<<31))>>32)
+}
+
+// offsetAndRttNanoseconds computes the clock offset and round trip time (in nanoseconds) from the four timestamps of
+// one exchange: t1 client sent, t2 server received, t3 server sent, t4 client received
+func offsetAndRttNanoseconds(t1_uint uint64, t2_uint uint64, t3_uint uint64, t4_uint uint64) (int64, int64) {
+	a := ntpTimestampDiff(t2_uint, t1_uint)
+	b := ntpTimestampDiff(t3_uint, t4_uint)
+	offset := (a >> 1) + (b >> 1) + (a & b & 1) // (a + b) / 2 without overflow
+	rtt := ntpTimestampDiff(t4_uint, t1_uint) - ntpTimestampDiff(t3_uint, t2_uint)
+	return ntpFixedToNanoseconds(offset), ntpFixedToNanoseconds(rtt)
+}
+
+// addOffsetAndRtt adds "offset" and "rtt" (seconds) and "offset_ns" and "rtt_ns" (nanoseconds) to a parsed result
+func addOffsetAndRtt(info map[string]interface{}, t1_uint uint64, t2_uint uint64, t3_uint uint64, t4_uint uint64) {
+	offset, rtt := offsetAndRttNanoseconds(t1_uint, t2_uint, t3_uint, t4_uint)
+	info["offset_ns"] = offset
+	info["rtt_ns"] = rtt
+	info["offset"] = float64(offset) / 1e9
+	info["rtt"] = float64(rtt) / 1e9
+}
+
 func getNtpVersionInResponse(data []byte) uint8 {
 	livmodeByte := uint8(data[0])
 	version := uint8((livmodeByte >> 3) & 0x07)
 	return version
 }
 
+// shiftServerTimestamps is used when simulating another era (simulatedClockShift != 0). Our own timestamps are
+// already shifted (they come from localNow), so we move the server timestamps of the response by the same amount, as
+// if the server also lived in that time. The result is a modified copy of the response.
+func shiftServerTimestamps(data []byte, draft string) []byte {
+	shifted := append([]byte{}, data...)
+	if len(shifted) < 48 {
+		return shifted
+	}
+	secs := int64(simulatedClockShift / time.Second)
+	nanos := int64(simulatedClockShift % time.Second)
+	delta := uint64(secs)<<32 + uint64((nanos<<32)/1e9) // wraps around, like the NTP timestamps
+	shift := func(from int) {
+		ts := binary.BigEndian.Uint64(shifted[from : from+8])
+		if ts != 0 { // 0 means "not set", keep it
+			binary.BigEndian.PutUint64(shifted[from:from+8], ts+delta)
+		}
+	}
+	version := getNtpVersionInResponse(shifted)
+	if version == uint8(5) {
+		// receive and transmit timestamps, plus the era they are in
+		eraPos := 5
+		if draft == "draft-ietf-ntp-ntpv5-06" {
+			eraPos = 13
+		}
+		recv := binary.BigEndian.Uint64(shifted[32:40])
+		era := ntpEraOf(ntp64ToTimeInEra(recv, int(shifted[eraPos])).Add(simulatedClockShift))
+		shift(32)
+		shift(40)
+		shifted[eraPos] = uint8(era)
+		return shifted
+	}
+	// reference, receive and transmit timestamps (origin is our own transmit timestamp)
+	shift(16)
+	shift(32)
+	shift(40)
+	return shifted
+}
+
 func parseAccordingToRightVersion(data []byte, t1_uint uint64, t4_uint uint64, client_cookie uint64, draft string, debug_output *strings.Builder) (map[string]interface{}, error) {
+	if simulatedClockShift != 0 {
+		data = shiftServerTimestamps(data, draft)
+		debug_output.WriteString(fmt.Sprintf("simulating another era: server timestamps moved by %v\n", simulatedClockShift))
+	}
 	version := getNtpVersionInResponse(data)
 	if version == uint8(1) {
 		return parseNTPv1Response(data, t1_uint, t4_uint)
@@ -61,6 +197,234 @@ func parseAccordingToRightVersion(data []byte, t1_uint uint64, t4_uint uint64, c
 	}
 }
 
+// buildExtensionField encodes an NTP extension field (type, length, body) padded to a multiple of 4 bytes.
+func buildExtensionField(typ uint16, body []byte) []byte {
+	length := 4 + len(body)
+	padded := (length + 3) &^ 3
+	ext := make([]byte, padded)
+	binary.BigEndian.PutUint16(ext[0:2], typ)
+	binary.BigEndian.PutUint16(ext[2:4], uint16(padded))
+	copy(ext[4:], body)
+	return ext
+}
+
+// findExtensionField returns the body of the first extension field of the given type found in a parsed result.
+func findExtensionField(result map[string]interface{}, typ uint16) ([]byte, bool) {
+	exts, ok := result["extensions"].([]map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	for _, ext := range exts {
+		if ext["type"] == typ {
+			data, _ := ext["data"].([]byte)
+			return data, true
+		}
+	}
+	return nil, false
+}
+
+// MeasurementOptions contains the settings shared by all the raw NTP measurements
+type MeasurementOptions struct {
+	HardwareTimestamps bool    // also ask for hardware timestamps (the NIC must already be configured for them)
+	Unconnected        bool    // use an unconnected socket and listen until the timeout (see unconnected.go)
+	Privacy            bool    // random transmit timestamp and source port, other client fields 0 (see privacy.go)
+	Key                *ntpKey // symmetric key of the NTPv3/NTPv4 requests (see auth.go), nil -> not authenticated
+}
+
+// ntpExchange is the result of sending one request and receiving its response
+type ntpExchange struct {
+	Request  []byte
+	Response []byte // exactly as received
+	Packet   []byte // the response to parse: without the MAC when it was verified
+	T1       uint64 // when the request was sent
+	T4       uint64 // when the response was received
+	T1Source string // where T1 comes from (TS_SOURCE_USERSPACE, TS_SOURCE_KERNEL_SOFTWARE, TS_SOURCE_KERNEL_HARDWARE)
+	T4Source string
+
+	// every datagram read for this request (the response, and in unconnected or privacy mode the ignored ones too)
+	ReceivedBytes     int
+	ReceivedDatagrams int
+
+	// only in unconnected mode
+	Datagrams      []map[string]interface{} // every datagram received until the timeout
+	Duplicates     int
+	SourceMismatch bool // the chosen response came from another address than the one we sent to
+	ResponseSource string
+
+	// only in privacy mode
+	Privacy bool
+	Ignored int // datagrams read from a connected socket that were not the response to our request
+
+	Auth map[string]interface{} // result of the MAC verification, only with a key
+}
+
+// sendAndReceive sends one request and waits (until timeout) for the response. With a connected socket the response
+// is the first datagram, with an unconnected one (see dialNTP) the valid one. In both cases we listen until the
+// timeout, to count every datagram the server sends back.
+// If possible (Linux), t1 and t4 are the kernel transmit and receive timestamps. Otherwise, they are taken just before
+// writing and just after reading. The error code is as in the NTP return codes (2 -> could not send, 3 -> timeout),
+// or 0 if everything went fine.
+func sendAndReceive(conn net.Conn, req []byte, timeout float64, opts MeasurementOptions) (ntpExchange, int, error) {
+	if opts.Privacy {
+		req = minimizeRequest(req)
+	}
+	authenticate := opts.Key != nil && len(req) >= NTP_PACKET_SIZE && authenticatedVersion(req)
+	if authenticate {
+		req = appendMAC(req, opts.Key) // after the privacy changes, the MAC covers the packet as sent
+	}
+	ex := ntpExchange{Request: req, T1Source: TS_SOURCE_USERSPACE, T4Source: TS_SOURCE_USERSPACE, Privacy: opts.Privacy}
+	if opts.Key != nil && !authenticate {
+		ex.Auth = map[string]interface{}{"status": AUTH_STATUS_NOT_SUPPORTED, "authenticated": false}
+	}
+	udpConn, isUDP := conn.(*net.UDPConn)
+	unconnected, isUnconnected := conn.(*unconnectedUDPConn)
+	if isUnconnected {
+		udpConn, isUDP = unconnected.UDPConn, true
+	}
+	kernel := isUDP && enableKernelTimestamps(udpConn, opts.HardwareTimestamps)
+	if kernel {
+		discardKernelTxTimestamps(udpConn)
+	}
+
+	sentAt := time.Now()
+	ex.T1 = nowToNtpUint64()
+	_, err := conn.Write(req)
+	if err != nil {
+		return ex, 2, fmt.Errorf("could not send data: %v", err)
+	}
+	if kernel {
+		// the transmit timestamp is in the error queue right after sending (the response stays in the socket buffer
+		// with its own receive timestamp in the meantime)
+		if t, source, ok := kernelTxTimestamp(udpConn, opts.HardwareTimestamps); ok {
+			sentAt = t
+			// kernel timestamps are from the real clock, so they also need the simulated shift (if any)
+			ex.T1, ex.T1Source = timeToNtpUint64(t.Add(simulatedClockShift)), source
+		}
+	}
+	pcapRecordNTP(conn, conn.RemoteAddr(), true, req, sentAt, "")
+	err = conn.SetReadDeadline(time.Now().Add(time.Duration(timeout * float64(time.Second))))
+	if err != nil {
+		return ex, 3, fmt.Errorf("error reading bytes: %v", err)
+	}
+	if isUnconnected {
+		err = receiveUnconnected(unconnected, req, &ex, kernel)
+		if err != nil {
+			return ex, 3, err
+		}
+	} else {
+		for {
+			resp := make([]byte, 1024)
+			oob := make([]byte, 512)
+			n, oobn := 0, 0
+			if isUDP {
+				n, oobn, _, _, err = udpConn.ReadMsgUDP(resp, oob)
+			} else {
+				n, err = conn.Read(resp)
+			}
+			ex.T4, ex.T4Source = nowToNtpUint64(), TS_SOURCE_USERSPACE
+			if err != nil {
+				if ex.Ignored > 0 {
+					return ex, 3, fmt.Errorf("measurement timeout: %v (%d datagrams ignored)", err, ex.Ignored)
+				}
+				return ex, 3, fmt.Errorf("measurement timeout: %v", err)
+			}
+			ex.Response = resp[:n]
+			ex.ReceivedBytes += n
+			ex.ReceivedDatagrams++
+			receivedAt := time.Now()
+			if kernel {
+				if t, source, ok := timestampFromControlMessages(oob[:oobn]); ok {
+					receivedAt = t
+					ex.T4, ex.T4Source = timeToNtpUint64(t.Add(simulatedClockShift)), source
+				}
+			}
+			// in privacy mode the origin timestamp must be our random transmit timestamp, anything else can be
+			// spoofed and is ignored (we keep reading until the deadline)
+			if opts.Privacy && !responseMatchesRequest(req, ex.Response) {
+				pcapRecordNTP(conn, conn.RemoteAddr(), false, ex.Response, receivedAt, "not a response to our request")
+				ex.Ignored++
+				continue
+			}
+			pcapRecordNTP(conn, conn.RemoteAddr(), false, ex.Response, receivedAt, "")
+			break
+		}
+		// keep reading until the deadline: the datagrams after the response (duplicates, more parts of a big
+		// answer) also count in the response size and the amplification factor
+		for {
+			extra := make([]byte, 1024)
+			n, err := conn.Read(extra)
+			if err != nil {
+				break
+			}
+			ex.ReceivedBytes += n
+			ex.ReceivedDatagrams++
+			pcapRecordNTP(conn, conn.RemoteAddr(), false, extra[:n], time.Now(), "after the response")
+		}
+	}
+	ex.Packet = ex.Response
+	if authenticate {
+		ex.Auth, ex.Packet = verifyMAC(ex.Response, opts.Key)
+	}
+	return ex, 0, nil
+}
+
+// addRawPackets adds the exact bytes sent and received (hex), so that the result can be audited or parsed again later
+func addRawPackets(result map[string]interface{}, request []byte, response []byte) {
+	result["request_raw"] = hex.EncodeToString(request)
+	result["request_size"] = len(request)
+	result["response_raw"] = hex.EncodeToString(response)
+	result["response_size"] = len(response)
+}
+
+// addAmplification shows how many bytes the server sent back for the bytes we sent. A factor above 1 means the
+// server can be used to amplify traffic (for example big extension fields in the response).
+func addAmplification(result map[string]interface{}, requestBytes int, responseBytes int, responseDatagrams int) {
+	result["request_bytes"] = requestBytes
+	result["response_bytes"] = responseBytes
+	result["response_datagrams"] = responseDatagrams
+	factor := 0.0
+	if requestBytes > 0 {
+		factor = float64(responseBytes) / float64(requestBytes)
+	}
+	result["amplification_factor"] = factor
+}
+
+// addExchangeInfo shows in the result the raw packets, where t1 and t4 come from and, in unconnected mode, all the
+// received datagrams
+func addExchangeInfo(result map[string]interface{}, ex ntpExchange) {
+	addRawPackets(result, ex.Request, ex.Response)
+	addAmplification(result, len(ex.Request), ex.ReceivedBytes, ex.ReceivedDatagrams)
+	result["t1_source"] = ex.T1Source
+	result["t4_source"] = ex.T4Source
+	if ex.Datagrams != nil {
+		result["received_datagrams"] = ex.Datagrams
+		result["duplicate_responses"] = ex.Duplicates
+		result["source_mismatch"] = ex.SourceMismatch
+		result["response_source"] = ex.ResponseSource
+	}
+	if ex.Auth != nil {
+		result["authentication"] = ex.Auth
+	}
+	if ex.Privacy {
+		result["privacy"] = true
+		result["ignored_datagrams"] = ex.Ignored
+	}
+}
+
+// localClockInfo describes the state of the clock of this machine (the vantage point). An offset measured from a
+// clock that is not synchronized (or has a big estimated error) is not very meaningful.
+func localClockInfo() map[string]interface{} {
+	state, err := readLocalClockState()
+	if err != nil {
+		return map[string]interface{}{
+			"available": false,
+			"error":     err.Error(),
+		}
+	}
+	state["available"] = true
+	return state
+}
+
 func printJson(server string, data map[string]interface{}) {
 	jsonData, err := json.MarshalIndent(data, "", "  ")
 	if err != nil {